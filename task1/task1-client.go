@@ -1,6 +1,8 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"flag"
 	"fmt"
 	"io"
@@ -50,7 +52,9 @@ func main() {
 			fmt.Print("Enter Filename: ")
 			fmt.Scanf("%s", &filename)
 			start := time.Now()
-			uploadFile(conn, username, filename)
+			if err := uploadFile(conn, username, filename); err != nil {
+				log.Println(err)
+			}
 			duration := time.Since(start)
 			fmt.Println("\nDuration: ", duration)
 		case 3:
@@ -62,7 +66,9 @@ func main() {
 			fmt.Print("Enter Filename: ")
 			fmt.Scanf("%s", &filename)
 			start := time.Now()
-			downloadFile(conn, username, filename)
+			if err := downloadFile(conn, username, filename); err != nil {
+				log.Println(err)
+			}
 			duration := time.Since(start)
 			fmt.Println("\nDuration: ", duration)
 		case 4:
@@ -74,7 +80,7 @@ func main() {
 	}
 }
 
-func uploadFile(conn io.Writer, username, filename string) error {
+func uploadFile(conn io.ReadWriter, username, filename string) error {
 	operation := "upload"
 	if err := sendMessage(conn, []byte(username)); err != nil {
 		return err
@@ -97,6 +103,20 @@ func uploadFile(conn io.Writer, username, filename string) error {
 		return err
 	}
 
+	sum := sha256.Sum256(fileBuff)
+	if err := sendMessage(conn, []byte(hex.EncodeToString(sum[:]))); err != nil {
+		return err
+	}
+
+	var bufferStatus bytes.Buffer
+	if err := readMessage(conn, &bufferStatus); err != nil {
+		return err
+	}
+
+	if bufferStatus.String() != "ok" {
+		return fmt.Errorf("uploading file (%s): %s", filename, bufferStatus.String())
+	}
+
 	return nil
 }
 
@@ -115,10 +135,11 @@ func downloadFile(conn io.ReadWriter, username, filename string) error {
 		return err
 	}
 
-	f, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY, 0644)
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
 	if err != nil {
 		return err
 	}
+	defer f.Close()
 
 	var bufferStatus bytes.Buffer
 	if err := readMessage(conn, &bufferStatus); err != nil {
@@ -130,9 +151,19 @@ func downloadFile(conn io.ReadWriter, username, filename string) error {
 		return nil
 	}
 
-	if err := readMessage(conn, f); err != nil {
+	h := sha256.New()
+	if err := readMessage(conn, io.MultiWriter(f, h)); err != nil {
 		return err
 	}
 
+	var bufferChecksum bytes.Buffer
+	if err := readMessage(conn, &bufferChecksum); err != nil {
+		return err
+	}
+
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != bufferChecksum.String() {
+		return fmt.Errorf("downloaded file (%s) has checksum (%s), expected (%s)", filename, sum, bufferChecksum.String())
+	}
+
 	return nil
 }
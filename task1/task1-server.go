@@ -2,7 +2,10 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"flag"
+	"io"
 	"io/ioutil"
 	"log"
 	"net"
@@ -16,6 +19,17 @@ type FileOwners struct {
 	ownership map[string][]string
 }
 
+// owns reports whether user uploaded filename. fo.mu must be held.
+func (fo *FileOwners) owns(user, filename string) bool {
+	for _, f := range fo.ownership[user] {
+		if f == filename {
+			return true
+		}
+	}
+
+	return false
+}
+
 func main() {
 	addr := ""
 	flag.StringVar(&addr, "address", "localhost:1234", "supply listening ip and port")
@@ -61,16 +75,52 @@ func handleUser(conn net.Conn, fo *FileOwners) {
 				log.Println(err)
 			}
 
-			f, err := os.OpenFile(filepath.Join(bufferUserName.String(), bufferFileName.String()), os.O_CREATE|os.O_WRONLY, 0644)
+			// Receive into a temporary file and only move it into place
+			// once its checksum has been verified.
+			path := filepath.Join(bufferUserName.String(), bufferFileName.String())
+			f, err := os.OpenFile(path+".part", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
 			if err != nil {
 				log.Println(err)
 			}
 
-			if err := readMessage(conn, f); err != nil {
+			h := sha256.New()
+			if err := readMessage(conn, io.MultiWriter(f, h)); err != nil {
 				log.Println(err)
 			}
+			f.Close()
 
-			fo.ownership[string(bufferUserName.Bytes())] = append(fo.ownership[string(bufferUserName.Bytes())], string(bufferFileName.Bytes()))
+			var bufferChecksum bytes.Buffer
+			if err := readMessage(conn, &bufferChecksum); err != nil {
+				log.Println(err)
+			}
+
+			sum := hex.EncodeToString(h.Sum(nil))
+			if sum != bufferChecksum.String() {
+				log.Printf("User (%s) uploaded file (%s) with checksum (%s), expected (%s)", bufferUserName.Bytes(), bufferFileName.Bytes(), sum, bufferChecksum.Bytes())
+				os.Remove(path + ".part")
+				if err := sendMessage(conn, []byte("checksum mismatch")); err != nil {
+					log.Println(err)
+				}
+				break
+			}
+
+			if err := os.Rename(path+".part", path); err != nil {
+				log.Println(err)
+			}
+
+			if err := ioutil.WriteFile(path+".sha256", []byte(sum), 0644); err != nil {
+				log.Println(err)
+			}
+
+			if err := sendMessage(conn, []byte("ok")); err != nil {
+				log.Println(err)
+			}
+
+			fo.mu.Lock()
+			if !fo.owns(bufferUserName.String(), bufferFileName.String()) {
+				fo.ownership[string(bufferUserName.Bytes())] = append(fo.ownership[string(bufferUserName.Bytes())], string(bufferFileName.Bytes()))
+			}
+			fo.mu.Unlock()
 			log.Printf("User (%s) uploading file (%s)", bufferUserName.Bytes(), bufferFileName.Bytes())
 		case "download":
 			var bufferFileName bytes.Buffer
@@ -78,13 +128,9 @@ func handleUser(conn net.Conn, fo *FileOwners) {
 				log.Println(err)
 			}
 
-			found := false
-			for _, filename := range fo.ownership[string(bufferUserName.Bytes())] {
-				if filename == bufferFileName.String() {
-					found = true
-					break
-				}
-			}
+			fo.mu.Lock()
+			found := fo.owns(bufferUserName.String(), bufferFileName.String())
+			fo.mu.Unlock()
 
 			if !found {
 				status := []byte("file not found")
@@ -100,7 +146,8 @@ func handleUser(conn net.Conn, fo *FileOwners) {
 				log.Println(err)
 			}
 
-			f, err := ioutil.ReadFile(filepath.Join(bufferUserName.String(), bufferFileName.String()))
+			path := filepath.Join(bufferUserName.String(), bufferFileName.String())
+			f, err := ioutil.ReadFile(path)
 			if err != nil {
 				log.Println(err)
 			}
@@ -109,6 +156,19 @@ func handleUser(conn net.Conn, fo *FileOwners) {
 				log.Println(err)
 			}
 
+			// Send the checksum recorded at upload time, so the client
+			// also notices files corrupted on our disk.
+			sum, err := ioutil.ReadFile(path + ".sha256")
+			if err != nil {
+				log.Println(err)
+				digest := sha256.Sum256(f)
+				sum = []byte(hex.EncodeToString(digest[:]))
+			}
+
+			if err := sendMessage(conn, sum); err != nil {
+				log.Println(err)
+			}
+
 			log.Printf("User (%s) downloading file (%s)", bufferUserName.Bytes(), bufferFileName.Bytes())
 		}
 	}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// recentCalls is how many of the latest RPCs the node remembers.
+const recentCalls = 64
+
+// recentEvents is how many of the latest membership events the admin
+// endpoint remembers.
+const recentEvents = 64
+
+// RPCStats sums up the RPCs of one procedure issued by the node.
+type RPCStats struct {
+	Proc       string
+	Calls      int64
+	Errors     int64
+	Timeouts   int64
+	AvgLatency time.Duration
+	MaxLatency time.Duration
+
+	total time.Duration
+}
+
+// RPCCall records a single RPC issued by the node.
+type RPCCall struct {
+	Proc    string
+	Addr    string
+	Start   time.Time
+	Latency time.Duration
+	Err     string `json:",omitempty"`
+}
+
+type RPCReport struct {
+	Procs  []RPCStats
+	Recent []RPCCall
+}
+
+// MembersReport is the failure detector's view of the neighbours and the
+// latest changes to it.
+type MembersReport struct {
+	Peers  []PeerStatus
+	Events []MemberEvent
+}
+
+// AdminStatus is what the admin endpoint serves at its root.
+type AdminStatus struct {
+	Node    NodeStatus
+	RPC     RPCReport
+	Members MembersReport
+}
+
+// rpcStats keeps per-procedure counters and the latest calls.
+type rpcStats struct {
+	mu     sync.Mutex
+	procs  map[string]*RPCStats
+	recent []RPCCall
+	next   int
+}
+
+func newRPCStats() *rpcStats {
+	return &rpcStats{procs: make(map[string]*RPCStats)}
+}
+
+func (s *rpcStats) record(call RPCCall, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ps, ok := s.procs[call.Proc]
+	if !ok {
+		ps = &RPCStats{Proc: call.Proc}
+		s.procs[call.Proc] = ps
+	}
+
+	ps.Calls++
+	ps.total += call.Latency
+	ps.AvgLatency = ps.total / time.Duration(ps.Calls)
+	if call.Latency > ps.MaxLatency {
+		ps.MaxLatency = call.Latency
+	}
+	if err != nil {
+		ps.Errors++
+		call.Err = err.Error()
+	}
+	if errors.Is(err, ErrTimeout) {
+		ps.Timeouts++
+	}
+
+	// recent is a ring buffer, next is its oldest entry once it is full.
+	if len(s.recent) < recentCalls {
+		s.recent = append(s.recent, call)
+		return
+	}
+	s.recent[s.next] = call
+	s.next = (s.next + 1) % recentCalls
+}
+
+// report returns the counters sorted by procedure and the latest calls,
+// oldest first.
+func (s *rpcStats) report() RPCReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var r RPCReport
+	for _, ps := range s.procs {
+		r.Procs = append(r.Procs, *ps)
+	}
+	sort.Slice(r.Procs, func(i, j int) bool { return r.Procs[i].Proc < r.Procs[j].Proc })
+
+	r.Recent = append(r.Recent, s.recent[s.next:]...)
+	r.Recent = append(r.Recent, s.recent[:s.next]...)
+
+	return r
+}
+
+// eventLog keeps the latest membership events of a node.
+type eventLog struct {
+	mu     sync.Mutex
+	events []MemberEvent
+}
+
+// logEvents subscribes to the membership events of the node until it shuts
+// down.
+func (n *Node) logEvents() *eventLog {
+	el := &eventLog{}
+	events, cancel := n.detector.subscribe()
+
+	go func() {
+		defer cancel()
+		for {
+			select {
+			case <-n.done():
+				return
+			case ev := <-events:
+				el.mu.Lock()
+				el.events = append(el.events, ev)
+				if len(el.events) > recentEvents {
+					el.events = el.events[1:]
+				}
+				el.mu.Unlock()
+			}
+		}
+	}()
+
+	return el
+}
+
+func (n *Node) members(el *eventLog) MembersReport {
+	el.mu.Lock()
+	defer el.mu.Unlock()
+
+	return MembersReport{Peers: n.detector.report(), Events: append([]MemberEvent(nil), el.events...)}
+}
+
+// AdminHandler serves the state of the node as JSON:
+//
+//	/         node status, RPC statistics and membership
+//	/status   node status: ID, neighbours, fingers and stored files
+//	/rpc      statistics of the RPCs issued by the node
+//	/members  state of the neighbours according to the failure detector
+//	          and the latest changes to it
+func (n *Node) AdminHandler() http.Handler {
+	el := n.logEvents()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		writeJSON(w, AdminStatus{Node: n.status(), RPC: n.stats.report(), Members: n.members(el)})
+	})
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, n.status())
+	})
+	mux.HandleFunc("/rpc", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, n.stats.report())
+	})
+	mux.HandleFunc("/members", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, n.members(el))
+	})
+
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.Println(err)
+	}
+}
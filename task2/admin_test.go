@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminHandler(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	n := NewNode("localhost:8080", Config{Store: NewMemStore()})
+	n.detector.watch([]string{"localhost:8081"})
+	mc := NewMockCaller("localhost:8085", "localhost:8070")
+	for i := 0; i < recentCalls+2; i++ {
+		var rr RingResp
+		n.call(context.Background(), mc, "localhost:8081", "Ring", "", &rr)
+	}
+	var gpr GetPredResp
+	n.call(context.Background(), mc, "localhost:8081", "GetPred", "", &gpr)
+
+	srv := httptest.NewServer(n.AdminHandler())
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var as AdminStatus
+	if err := json.NewDecoder(resp.Body).Decode(&as); err != nil {
+		t.Fatal(err)
+	}
+
+	if as.Node.ID != n.id() || len(as.Node.Fingers) != int(n.bits) {
+		t.Errorf("Expected ID (%v) with (%v) fingers, found (%v) with (%v)", n.id(), n.bits, as.Node.ID, len(as.Node.Fingers))
+	}
+	if start := n.id().fingerStart(3, n.bits); as.Node.Fingers[3].Start != start {
+		t.Errorf("Expected finger 3 to start at (%v), found (%v)", start, as.Node.Fingers[3].Start)
+	}
+
+	if len(as.RPC.Procs) != 2 || as.RPC.Procs[1].Proc != "Ring" || as.RPC.Procs[1].Calls != recentCalls+2 {
+		t.Errorf("Expected (%v) Ring calls, found (%v)", recentCalls+2, as.RPC.Procs)
+	}
+	if len(as.RPC.Recent) != recentCalls || as.RPC.Recent[recentCalls-1].Proc != "GetPred" {
+		t.Errorf("Expected the latest (%v) calls ending with GetPred, found (%v)", recentCalls, as.RPC.Recent)
+	}
+
+	if len(as.Members.Peers) != 1 || as.Members.Peers[0].State != PeerAlive {
+		t.Errorf("Expected (%v) to be %v, found (%v)", "localhost:8081", PeerAlive, as.Members.Peers)
+	}
+
+	resp, err = http.Get(srv.URL + "/nope")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected status (%v), found (%v)", http.StatusNotFound, resp.StatusCode)
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/rpc"
+	"reflect"
+	"sync"
+	"time"
+)
+
+type Caller interface {
+	Call(addr, proc string, args interface{}, reply interface{}) error
+	// CallContext is like Call but gives up once ctx is done.
+	CallContext(ctx context.Context, addr, proc string, args interface{}, reply interface{}) error
+}
+
+// ErrTimeout is returned (wrapped) by RPCCaller when a call misses its
+// deadline. Use errors.Is to check for it.
+var ErrTimeout = errors.New("rpc call timed out")
+
+const (
+	defaultIdleTimeout = time.Minute
+	defaultPingAfter   = 5 * time.Second
+)
+
+// RPCCaller keeps one long-lived *rpc.Client per peer address. net/rpc
+// clients multiplex concurrent calls over a single connection, so a single
+// connection per peer is enough to avoid a TCP handshake per call.
+type RPCCaller struct {
+	// IdleTimeout is how long an unused connection stays open.
+	IdleTimeout time.Duration
+	// PingAfter is how long a connection may sit unused before it is
+	// health checked with a Ping before being reused.
+	PingAfter time.Duration
+
+	mu    sync.Mutex
+	conns map[string]*pooledConn
+}
+
+type pooledConn struct {
+	client   *rpc.Client
+	lastUsed time.Time
+}
+
+func NewRPCCaller() *RPCCaller {
+	return &RPCCaller{
+		IdleTimeout: defaultIdleTimeout,
+		PingAfter:   defaultPingAfter,
+		conns:       make(map[string]*pooledConn),
+	}
+}
+
+func (rc *RPCCaller) Call(addr, proc string, args interface{}, reply interface{}) error {
+	return rc.CallContext(context.Background(), addr, proc, args, reply)
+}
+
+func (rc *RPCCaller) CallContext(ctx context.Context, addr, proc string, args interface{}, reply interface{}) error {
+	pc, err := rc.get(ctx, addr)
+	if err != nil {
+		return err
+	}
+
+	sent, err := rc.call(ctx, addr, pc, proc, args, reply)
+	if isBrokenConn(err) {
+		rc.evict(addr, pc)
+
+		// The peer closed the connection (e.g. it restarted), so retry
+		// once over a fresh one, unless the peer may have run a call that
+		// is not safe to repeat.
+		if sent && !idempotent[proc] {
+			return err
+		}
+		if pc, err = rc.get(ctx, addr); err != nil {
+			return err
+		}
+
+		_, err = rc.call(ctx, addr, pc, proc, args, reply)
+		if isBrokenConn(err) {
+			rc.evict(addr, pc)
+		}
+	}
+
+	return err
+}
+
+// idempotent lists the procedures that may run twice when a call is retried.
+var idempotent = map[string]bool{
+	"Ping":             true,
+	"Ring":             true,
+	"Status":           true,
+	"Lookup":           true,
+	"LookupIterative":  true,
+	"ClosestPreceding": true,
+	"GetSucc":          true,
+	"GetSuccList":      true,
+	"GetPred":          true,
+	"RetrieveFile":     true,
+	"StatFile":         true,
+	"LocalFiles":       true,
+	"ListFiles":        true,
+}
+
+// call runs a single call over pc. It reports whether the request may have
+// reached the peer. net/rpc calls cannot be aborted, so when ctx is done first
+// the call is abandoned. The connection stays pooled, since other calls may
+// be in flight over it, and the late reply is decoded into a copy nobody
+// reads.
+func (rc *RPCCaller) call(ctx context.Context, addr string, pc *pooledConn, proc string, args interface{}, reply interface{}) (bool, error) {
+	out := reflect.New(reflect.TypeOf(reply).Elem())
+	call := pc.client.Go("Node."+proc, args, out.Interface(), make(chan *rpc.Call, 1))
+	done := func() error {
+		if call.Error != nil {
+			return decodeError(call.Error)
+		}
+		reflect.ValueOf(reply).Elem().Set(out.Elem())
+		return nil
+	}
+
+	// net/rpc fails calls over a connection it knows to be shut down
+	// before writing them.
+	select {
+	case <-call.Done:
+		return call.Error != rpc.ErrShutdown, done()
+	default:
+	}
+
+	select {
+	case <-call.Done:
+		return true, done()
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			return true, fmt.Errorf("%w: %s on %s", ErrTimeout, proc, addr)
+		}
+		return true, ctx.Err()
+	}
+}
+
+// Close closes every pooled connection.
+func (rc *RPCCaller) Close() error {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	var err error
+	for addr, pc := range rc.conns {
+		if cerr := pc.client.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		delete(rc.conns, addr)
+	}
+
+	return err
+}
+
+// get returns a healthy connection to addr, dialing a new one if needed.
+func (rc *RPCCaller) get(ctx context.Context, addr string) (*pooledConn, error) {
+	now := time.Now()
+
+	rc.mu.Lock()
+	rc.closeIdle(now)
+	pc, ok := rc.conns[addr]
+	var idle time.Duration
+	if ok {
+		idle = now.Sub(pc.lastUsed)
+		pc.lastUsed = now
+	}
+	rc.mu.Unlock()
+
+	if ok && idle > rc.PingAfter {
+		var empty string
+		if _, err := rc.call(ctx, addr, pc, "Ping", "", &empty); err != nil {
+			if ctx.Err() != nil {
+				return nil, err
+			}
+
+			rc.evict(addr, pc)
+			ok = false
+		}
+	}
+
+	if ok {
+		return pc, nil
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp4", addr)
+	if err != nil {
+		return nil, err
+	}
+	client := rpc.NewClient(conn)
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	// Another goroutine may have dialed the same peer in the meantime.
+	if existing, ok := rc.conns[addr]; ok {
+		client.Close()
+		existing.lastUsed = now
+		return existing, nil
+	}
+
+	pc = &pooledConn{client: client, lastUsed: now}
+	rc.conns[addr] = pc
+
+	return pc, nil
+}
+
+// evict closes pc and removes it from the pool if it is still the pooled
+// connection for addr.
+func (rc *RPCCaller) evict(addr string, pc *pooledConn) {
+	rc.mu.Lock()
+	if rc.conns[addr] == pc {
+		delete(rc.conns, addr)
+	}
+	rc.mu.Unlock()
+
+	pc.client.Close()
+}
+
+// closeIdle closes connections that have not been used for IdleTimeout.
+// rc.mu must be held.
+func (rc *RPCCaller) closeIdle(now time.Time) {
+	for addr, pc := range rc.conns {
+		if now.Sub(pc.lastUsed) > rc.IdleTimeout {
+			pc.client.Close()
+			delete(rc.conns, addr)
+		}
+	}
+}
+
+// isBrokenConn reports whether err means the pooled connection is unusable.
+func isBrokenConn(err error) bool {
+	return err == rpc.ErrShutdown || err == io.EOF || err == io.ErrUnexpectedEOF
+}
+
+// isDialErr reports whether err means the peer could not be reached at all.
+func isDialErr(err error) bool {
+	var oe *net.OpError
+	return errors.As(err, &oe) && oe.Op == "dial"
+}
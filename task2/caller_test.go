@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/rpc"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRPCCallerPool(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	srv := rpc.NewServer()
+	if err := srv.Register(NewNode(ln.Addr().String(), Config{})); err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	var conns []net.Conn
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+			go srv.ServeConn(conn)
+		}
+	}()
+
+	rc := NewRPCCaller()
+	defer rc.Close()
+
+	var gsr GetSuccResp
+	for i := 0; i < 5; i++ {
+		if err := rc.Call(ln.Addr().String(), "GetSucc", "", &gsr); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mu.Lock()
+	if len(conns) != 1 {
+		t.Errorf("expected a single pooled connection, found (%v)", len(conns))
+	}
+
+	// Break the pooled connection from the server side.
+	conns[0].Close()
+	mu.Unlock()
+
+	if err := rc.Call(ln.Addr().String(), "GetSucc", "", &gsr); err != nil {
+		t.Errorf("call over a broken connection was not retried: %v", err)
+	}
+
+	mu.Lock()
+	if len(conns) != 2 {
+		t.Errorf("expected the broken connection to be replaced, found (%v) connections", len(conns))
+	}
+	mu.Unlock()
+}
+
+type hangingNode struct {
+	release chan struct{}
+}
+
+func (hn *hangingNode) Ping(empty string, reply *string) error {
+	<-hn.release
+	return nil
+}
+
+func (hn *hangingNode) GetPred(empty string, reply *string) error {
+	*reply = "pred"
+	return nil
+}
+
+func TestRPCCallerTimeout(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	hn := &hangingNode{release: make(chan struct{})}
+	defer close(hn.release)
+
+	srv := rpc.NewServer()
+	if err := srv.RegisterName("Node", hn); err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	conns := 0
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns++
+			mu.Unlock()
+			go srv.ServeConn(conn)
+		}
+	}()
+
+	rc := NewRPCCaller()
+	defer rc.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	var empty string
+	err = rc.CallContext(ctx, ln.Addr().String(), "Ping", "", &empty)
+	if !errors.Is(err, ErrTimeout) {
+		t.Errorf("expected a timeout error, found (%v)", err)
+	}
+
+	// The timed out call must not take the shared connection down.
+	var pred string
+	if err := rc.Call(ln.Addr().String(), "GetPred", "", &pred); err != nil || pred != "pred" {
+		t.Errorf("Expected (pred), found (%v), (%v)", pred, err)
+	}
+
+	mu.Lock()
+	if conns != 1 {
+		t.Errorf("Expected a single connection, found (%v)", conns)
+	}
+	mu.Unlock()
+}
+
+// droppingNode drops the connection the first time each of its methods is
+// called, after running it.
+type droppingNode struct {
+	mu    sync.Mutex
+	calls map[string]int
+	conns []net.Conn
+}
+
+func (dn *droppingNode) run(proc string) {
+	dn.mu.Lock()
+	defer dn.mu.Unlock()
+
+	dn.calls[proc]++
+	if dn.calls[proc] == 1 {
+		for _, conn := range dn.conns {
+			conn.Close()
+		}
+	}
+}
+
+func (dn *droppingNode) Ping(empty string, reply *string) error {
+	dn.run("Ping")
+	return nil
+}
+
+func (dn *droppingNode) Depart(empty string, reply *string) error {
+	dn.run("Depart")
+	return nil
+}
+
+func TestRPCCallerRetry(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	dn := &droppingNode{calls: make(map[string]int)}
+	srv := rpc.NewServer()
+	if err := srv.RegisterName("Node", dn); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			dn.mu.Lock()
+			dn.conns = append(dn.conns, conn)
+			dn.mu.Unlock()
+			go srv.ServeConn(conn)
+		}
+	}()
+
+	tests := []struct {
+		proc  string
+		calls int
+		ok    bool
+	}{
+		{"Ping", 2, true},
+		{"Depart", 1, false},
+	}
+
+	for _, test := range tests {
+		rc := NewRPCCaller()
+		var empty string
+		err := rc.Call(ln.Addr().String(), test.proc, "", &empty)
+		rc.Close()
+
+		dn.mu.Lock()
+		calls := dn.calls[test.proc]
+		dn.mu.Unlock()
+		if (err == nil) != test.ok || calls != test.calls {
+			t.Errorf("Expected (%v) calls of (%v) succeeding (%v), found (%v), (%v)", test.calls, test.proc, test.ok, calls, err)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+// Exit codes of the peer and client commands.
+const (
+	exitOK    = 0
+	exitErr   = 1
+	exitUsage = 2
+	// exitInconsistent reports a ring whose pointers do not agree.
+	exitInconsistent = 3
+	// The following report the code of a failed request, see Error.
+	// CodeInternal maps to exitErr.
+	exitNotFound       = 4
+	exitNotResponsible = 5
+	exitQuota          = 6
+	exitChecksum       = 7
+	exitUnavailable    = 8
+)
+
+// exitCodes maps error codes to exit codes, and hints explain them.
+var exitCodes = map[ErrorCode]struct {
+	code int
+	hint string
+}{
+	CodeNotFound:         {exitNotFound, "no such file in the ring"},
+	CodeNotResponsible:   {exitNotResponsible, "the node is not responsible for the key, the ring may still be settling"},
+	CodeQuotaExceeded:    {exitQuota, "the responsible node is out of space"},
+	CodeChecksumMismatch: {exitChecksum, "the content is corrupt"},
+	CodeUnavailable:      {exitUnavailable, "a node could not be reached"},
+	CodeInternal:         {exitErr, "the request failed"},
+}
+
+// parseArgs parses the flags of fs, which may come before, between or after
+// the positional arguments, and returns the positional arguments.
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// subcommand is one verb of a command line tool.
+type subcommand struct {
+	name  string
+	usage string
+	run   func(args []string) int
+}
+
+// dispatch runs the subcommand named by the first argument and returns its
+// exit code.
+func dispatch(prog string, cmds []subcommand, args []string) int {
+	if len(args) > 0 {
+		for _, cmd := range cmds {
+			if cmd.name == args[0] {
+				return cmd.run(args[1:])
+			}
+		}
+		fmt.Fprintf(os.Stderr, "%v: unknown command (%v)\n", prog, args[0])
+	}
+
+	fmt.Fprintf(os.Stderr, "usage:\n")
+	for _, cmd := range cmds {
+		fmt.Fprintf(os.Stderr, "  %v %v %v\n", prog, cmd.name, cmd.usage)
+	}
+
+	return exitUsage
+}
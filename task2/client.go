@@ -1,14 +1,221 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"math/big"
 	"os"
+	"path/filepath"
 	"time"
 )
 
+// lookupProc is the RPC used to resolve keys, selected with -lookup.
+var lookupProc = "Lookup"
+
+// owner is the namespace files are stored and looked up in, selected with
+// -owner. See fileName.
+var owner = ""
+
 func main() {
+	os.Exit(dispatch("client", []subcommand{
+		{"put", "[-peer ADDR] [-owner NAME] FILE", put},
+		{"get", "[-peer ADDR] [-owner NAME] KEY [-o PATH]", get},
+		{"delete", "[-peer ADDR] [-owner NAME] KEY", del},
+		{"stat", "[-peer ADDR] [-owner NAME] KEY", stat},
+		{"list", "[-peer ADDR] [-owner NAME] [-limit N] [-from ID] [-all]", list},
+		{"lookup", "[-peer ADDR] [-id] KEY", lookup},
+		{"crawl", "[-peer ADDR] [-format text|json|dot] [-limit N]", crawl},
+		{"repl", "[-lookup MODE]", repl},
+	}, os.Args[1:]))
+}
+
+// clientFlags returns a flag set with the flags shared by every client
+// command, storing the peer address in peer.
+func clientFlags(name string, peer *string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.StringVar(peer, "peer", "localhost:1234", "address of a ring member to send requests to")
+	fs.Func("lookup", "lookup mode: recursive or iterative", func(mode string) error {
+		switch mode {
+		case LookupRecursive:
+			lookupProc = "Lookup"
+		case LookupIterative:
+			lookupProc = "LookupIterative"
+		default:
+			return fmt.Errorf("unknown lookup mode (%v)", mode)
+		}
+		return nil
+	})
+	fs.StringVar(&owner, "owner", "", "namespace to store and look up files in, empty for the shared one; not authenticated")
+
+	return fs
+}
+
+// exitCode reports err and maps its code to the exit code of a command.
+func exitCode(err error) int {
+	if err == nil {
+		return exitOK
+	}
+
+	ec := exitCodes[codeOf(err)]
+	log.Printf("%v: %v", ec.hint, err)
+	return ec.code
+}
+
+func put(args []string) int {
+	peer := ""
+	fs := clientFlags("put", &peer)
+	rest, err := parseArgs(fs, args)
+	if err != nil || len(rest) != 1 || !validRemoteName(rest[0]) {
+		fs.Usage()
+		return exitUsage
+	}
+
+	// A missing local file is not a missing file in the ring.
+	if _, err := os.Stat(rest[0]); err != nil {
+		log.Println(err)
+		return exitErr
+	}
+
+	return exitCode(UploadFile(rest[0], peer))
+}
+
+func get(args []string) int {
+	peer := ""
+	output := ""
+	fs := clientFlags("get", &peer)
+	fs.StringVar(&output, "o", "", "path to write the file to, defaults to its base name")
+	rest, err := parseArgs(fs, args)
+	if err != nil || len(rest) != 1 || !validRemoteName(rest[0]) {
+		fs.Usage()
+		return exitUsage
+	}
+
+	if output == "" {
+		output = filepath.Base(rest[0])
+	}
+
+	// A missing output directory is not a missing file in the ring either.
+	if _, err := os.Stat(filepath.Dir(output)); err != nil {
+		log.Println(err)
+		return exitErr
+	}
+
+	return exitCode(RetrieveFile(rest[0], output, peer))
+}
+
+func del(args []string) int {
+	peer := ""
+	fs := clientFlags("delete", &peer)
+	rest, err := parseArgs(fs, args)
+	if err != nil || len(rest) != 1 || !validRemoteName(rest[0]) {
+		fs.Usage()
+		return exitUsage
+	}
+
+	return exitCode(DeleteFile(rest[0], peer))
+}
+
+func stat(args []string) int {
+	peer := ""
+	fs := clientFlags("stat", &peer)
+	rest, err := parseArgs(fs, args)
+	if err != nil || len(rest) != 1 || !validRemoteName(rest[0]) {
+		fs.Usage()
+		return exitUsage
+	}
+
+	return exitCode(StatFile(rest[0], peer))
+}
+
+func list(args []string) int {
+	peer := ""
+	from := ""
+	limit := 0
+	all := false
+	fs := clientFlags("list", &peer)
+	fs.IntVar(&limit, "limit", defaultListLimit, "number of files per page")
+	fs.StringVar(&from, "from", "", "numeric identifier to start the page at, as printed by a previous page")
+	fs.BoolVar(&all, "all", false, "list every page")
+	rest, err := parseArgs(fs, args)
+	if err != nil || len(rest) != 0 {
+		fs.Usage()
+		return exitUsage
+	}
+
+	return exitCode(ListFiles(from, limit, all, peer))
+}
+
+func lookup(args []string) int {
+	peer := ""
+	raw := false
+	fs := clientFlags("lookup", &peer)
+	fs.BoolVar(&raw, "id", false, "treat KEY as a numeric identifier instead of a name to hash")
+	rest, err := parseArgs(fs, args)
+	if err != nil || len(rest) != 1 {
+		fs.Usage()
+		return exitUsage
+	}
+
+	return exitCode(Lookup(rest[0], raw, peer))
+}
+
+// crawl walks the ring and prints its members. It exits with
+// exitInconsistent if the walk finds issues.
+func crawl(args []string) int {
+	peer := ""
+	format := ""
+	limit := 0
+	var timeout time.Duration
+	fs := clientFlags("crawl", &peer)
+	fs.StringVar(&format, "format", "text", "output format: text, json or dot")
+	fs.IntVar(&limit, "limit", 1<<16, "maximum number of nodes to visit")
+	fs.DurationVar(&timeout, "timeout", defaultCallTimeout, "deadline for every RPC")
+	rest, err := parseArgs(fs, args)
+	if err != nil || len(rest) != 0 {
+		fs.Usage()
+		return exitUsage
+	}
+
+	write := map[string]func(CrawlResult, io.Writer) error{
+		"text": CrawlResult.WriteText,
+		"json": CrawlResult.WriteJSON,
+		"dot":  CrawlResult.WriteDOT,
+	}[format]
+	if write == nil {
+		log.Printf("unknown format (%v)", format)
+		return exitUsage
+	}
+
+	rpccaller := NewRPCCaller()
+	defer rpccaller.Close()
+
+	cr, err := Crawl(context.Background(), rpccaller, peer, limit, timeout)
+	if err != nil {
+		return exitCode(err)
+	}
+
+	if err := write(cr, os.Stdout); err != nil {
+		return exitCode(err)
+	}
+
+	if len(cr.Issues) != 0 || !cr.Complete {
+		return exitInconsistent
+	}
+
+	return exitOK
+}
+
+// repl runs the interactive menu.
+func repl(args []string) int {
+	fs := clientFlags("repl", new(string))
+	if rest, err := parseArgs(fs, args); err != nil || len(rest) != 0 {
+		fs.Usage()
+		return exitUsage
+	}
 
 	nodeAddr := ""
 	fmt.Print("Enter a peer node address: ")
@@ -28,7 +235,9 @@ func main() {
 			filename := ""
 			fmt.Scanf("%s\n", &filename)
 			start := time.Now()
-			UploadFile(filename, nodeAddr)
+			if err := UploadFile(filename, nodeAddr); err != nil {
+				log.Println(err)
+			}
 			duration := time.Since(start)
 			fmt.Println("\nDuration: ", duration)
 		case 2:
@@ -36,56 +245,318 @@ func main() {
 			filename := ""
 			fmt.Scanf("%s\n", &filename)
 			start := time.Now()
-			RetrieveFile(filename, nodeAddr)
+			if err := RetrieveFile(filename, filename, nodeAddr); err != nil {
+				log.Println(err)
+			}
 			duration := time.Since(start)
 			fmt.Println("\nDuration: ", duration)
 		case 3:
 			fmt.Print("Exiting")
-			return
+			return exitOK
 		}
 	}
 }
 
-func UploadFile(filename, nodeAddr string) {
+// Lookup resolves the node responsible for key, a name or, with raw set, a
+// numeric identifier.
+func Lookup(key string, raw bool, nodeAddr string) error {
 	rpccaller := NewRPCCaller()
+	defer rpccaller.Close()
 
-	content, err := ioutil.ReadFile(filename)
-	if err != nil {
+	var rr RingResp
+	if err := rpccaller.Call(nodeAddr, "Ring", "", &rr); err != nil {
+		return err
+	}
+
+	id := HashKey(key, rr.Bits)
+	if raw {
+		var err error
+		if id, err = ParseKey(key, rr.Bits); err != nil {
+			return err
+		}
+	}
+
+	var lr LookupResp
+	if err := rpccaller.Call(nodeAddr, lookupProc, id, &lr); err != nil {
+		return err
+	}
+	printHops(lr)
+
+	fmt.Printf("Found: %v (%v) responsible for key (%v)\n", lr.Addr, lr.ID, id)
+	return nil
+}
+
+// remoteName returns the name a local path is stored under in the ring.
+// Nodes only accept clean relative names.
+func remoteName(filename string) string {
+	return filepath.ToSlash(filepath.Clean(filename))
+}
+
+// validRemoteName reports whether the ring accepts the name filename is
+// stored under, see checkName. Absolute paths and paths leaving the working
+// directory are refused, rather than stored under a name that drops part of
+// the path.
+func validRemoteName(filename string) bool {
+	if err := checkName(owner, remoteName(filename)); err != nil {
 		log.Println(err)
-		return
+		return false
+	}
+
+	return true
+}
+
+func UploadFile(filename, nodeAddr string) error {
+	rpccaller := NewRPCCaller()
+	defer rpccaller.Close()
+
+	var rr RingResp
+	if err := rpccaller.Call(nodeAddr, "Ring", "", &rr); err != nil {
+		return err
 	}
+	name := remoteName(filename)
+	key := HashKey(fileName(owner, name), rr.Bits)
 
 	var lr LookupResp
-	rpccaller.Call(nodeAddr, "Lookup", ID(filename), &lr)
+	if err := rpccaller.Call(nodeAddr, lookupProc, key, &lr); err != nil {
+		return err
+	}
+	printHops(lr)
+
+	var ufr *UploadFileResp
+	addr, err := followRedirects(lr.Addr, func(addr string) error {
+		call := func(proc string, args interface{}, reply interface{}) error {
+			return rpccaller.Call(addr, proc, args, reply)
+		}
+
+		var err error
+		ufr, err = pushFile(call, filename, UploadFileReq{Filename: name, Owner: owner, ID: key})
+		return err
+	})
+	if codeOf(err) == CodeQuotaExceeded {
+		return fmt.Errorf("(%v) refused (%v): %w", addr, filename, err)
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Stored (%v) on (%v) with SHA-256 (%v)\n", filename, addr, ufr.Checksum)
+	return nil
+}
+
+// maxRedirects bounds how many "not responsible" redirects a request
+// follows before it gives up.
+const maxRedirects = 3
 
-	var ufr UploadFileResp
-	rpccaller.Call(lr.Addr, "UploadFile", UploadFileReq{
-		Filename: filename,
-		Content:  content,
-		ID:       ID(filename),
-	}, &ufr)
+// followRedirects runs try against addr and then against every node a "not
+// responsible" error redirects to, at most maxRedirects times. It returns
+// the node that answered last.
+func followRedirects(addr string, try func(addr string) error) (string, error) {
+	for i := 0; ; i++ {
+		err := try(addr)
+		to, ok := redirect(err)
+		if !ok || i == maxRedirects {
+			return addr, err
+		}
+
+		log.Printf("(%v) is not responsible, trying (%v)", addr, to)
+		addr = to
+	}
 }
 
-func RetrieveFile(filename, nodeAddr string) {
+// RetrieveFile fetches filename from the ring into output.
+func RetrieveFile(filename, output, nodeAddr string) error {
+	filename = remoteName(filename)
+
 	rpccaller := NewRPCCaller()
+	defer rpccaller.Close()
+
+	var rr RingResp
+	if err := rpccaller.Call(nodeAddr, "Ring", "", &rr); err != nil {
+		return err
+	}
+	key := HashKey(fileName(owner, filename), rr.Bits)
+
+	var lr LookupResp
+	if err := rpccaller.Call(nodeAddr, lookupProc, key, &lr); err != nil {
+		return err
+	}
+	printHops(lr)
+
+	// Download next to output and only move the verified file into place,
+	// so that a failed download neither leaves a partial file behind nor
+	// clobbers an existing one.
+	f, err := ioutil.TempFile(filepath.Dir(output), "."+filepath.Base(output)+".part-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	// Fall back to the replicas held by the successors of the responsible
+	// node when it cannot serve the file.
+	for i := 0; i < defaultReplicas; i++ {
+		var rfr *RetrieveFileResp
+		try := func(addr string) error {
+			call := func(proc string, args interface{}, reply interface{}) error {
+				return rpccaller.Call(addr, proc, args, reply)
+			}
+
+			if err := f.Truncate(0); err != nil {
+				return err
+			}
+			if _, err := f.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+
+			var err error
+			rfr, err = pullFile(call, RetrieveFileReq{Filename: filename, Owner: owner, ID: key, Replica: i > 0}, f)
+			return err
+		}
+
+		// Only the responsible node redirects, the others serve their
+		// replicas.
+		var err error
+		if i == 0 {
+			var addr string
+			addr, err = followRedirects(lr.Addr, try)
+			lr = LookupResp{Addr: addr, ID: HashKey(addr, rr.Bits)}
+		} else {
+			err = try(lr.Addr)
+		}
+		if err == nil {
+			if err := f.Chmod(0644); err != nil {
+				return err
+			}
+			if err := f.Close(); err != nil {
+				return err
+			}
+			if err := os.Rename(f.Name(), output); err != nil {
+				return err
+			}
+
+			fmt.Printf("Retrieved (%v) from (%v), SHA-256 (%v) verified\n", filename, lr.Addr, rfr.Checksum)
+			return nil
+		}
+
+		log.Printf("retrieving from (%v): %v", lr.Addr, err)
+		if i == defaultReplicas-1 {
+			return err
+		}
+
+		if err := rpccaller.Call(nodeAddr, lookupProc, lr.ID.Add(big.NewInt(1), rr.Bits), &lr); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// locate resolves the key of filename and the node responsible for it.
+func locate(rpccaller *RPCCaller, filename, nodeAddr string) (Key, LookupResp, error) {
+	var rr RingResp
+	if err := rpccaller.Call(nodeAddr, "Ring", "", &rr); err != nil {
+		return Key{}, LookupResp{}, err
+	}
+	key := HashKey(fileName(owner, filename), rr.Bits)
 
 	var lr LookupResp
-	rpccaller.Call(nodeAddr, "Lookup", ID(filename), &lr)
+	if err := rpccaller.Call(nodeAddr, lookupProc, key, &lr); err != nil {
+		return Key{}, LookupResp{}, err
+	}
+	printHops(lr)
+
+	return key, lr, nil
+}
+
+// DeleteFile removes filename and its replicas from the ring.
+func DeleteFile(filename, nodeAddr string) error {
+	filename = remoteName(filename)
+
+	rpccaller := NewRPCCaller()
+	defer rpccaller.Close()
 
-	var rfr RetrieveFileResp
-	rpccaller.Call(lr.Addr, "RetrieveFile", RetrieveFileReq{
-		Filename: filename,
-		ID:       ID(filename),
-	}, &rfr)
+	key, lr, err := locate(rpccaller, filename, nodeAddr)
+	if err != nil {
+		return err
+	}
 
-	f, err := os.OpenFile(rfr.Filename, os.O_CREATE|os.O_WRONLY, 0644)
+	addr, err := followRedirects(lr.Addr, func(addr string) error {
+		return rpccaller.Call(addr, "DeleteFile", DeleteFileReq{Filename: filename, Owner: owner, ID: key}, new(string))
+	})
 	if err != nil {
-		log.Println(err)
-		return
+		return err
 	}
 
-	if _, err := f.Write(rfr.Content); err != nil {
-		log.Println(err)
-		return
+	fmt.Printf("Deleted (%v) from (%v)\n", filename, addr)
+	return nil
+}
+
+// StatFile prints what the responsible node knows about filename.
+func StatFile(filename, nodeAddr string) error {
+	filename = remoteName(filename)
+
+	rpccaller := NewRPCCaller()
+	defer rpccaller.Close()
+
+	key, lr, err := locate(rpccaller, filename, nodeAddr)
+	if err != nil {
+		return err
+	}
+
+	var fs FileStat
+	if _, err := followRedirects(lr.Addr, func(addr string) error {
+		return rpccaller.Call(addr, "StatFile", StatFileReq{Filename: filename, Owner: owner, ID: key}, &fs)
+	}); err != nil {
+		return err
+	}
+
+	fmt.Printf("Name: %v\nOwner: %v\nID: %v\nSize: %d\nSHA-256: %v\nNode: %v\nStored: %v\n", fs.Name, fs.Owner, fs.ID, fs.Size, fs.Checksum, fs.Node, fs.Stored.Format(time.RFC3339))
+	return nil
+}
+
+// ListFiles prints the files of owner in the ring a page at a time, starting at the
+// numeric identifier from, or every page with all set.
+func ListFiles(from string, limit int, all bool, nodeAddr string) error {
+	rpccaller := NewRPCCaller()
+	defer rpccaller.Close()
+
+	var lf ListFilesReq
+	if from != "" {
+		var rr RingResp
+		if err := rpccaller.Call(nodeAddr, "Ring", "", &rr); err != nil {
+			return err
+		}
+
+		var err error
+		if lf.From, err = ParseKey(from, rr.Bits); err != nil {
+			return err
+		}
+	}
+	lf.Owner, lf.Limit = owner, limit
+
+	for {
+		var lfr ListFilesResp
+		if err := rpccaller.Call(nodeAddr, "ListFiles", lf, &lfr); err != nil {
+			return err
+		}
+
+		for _, fs := range lfr.Files {
+			fmt.Printf("%v\t%v\t%d\t%v\t%v\n", fs.ID, fs.Name, fs.Size, fs.Node, fs.Stored.Format(time.RFC3339))
+		}
+
+		if !lfr.More {
+			return nil
+		}
+		if !all {
+			fmt.Printf("More files follow, continue with -from %v\n", lfr.Next)
+			return nil
+		}
+		lf.From = lfr.Next
+	}
+}
+
+func printHops(lr LookupResp) {
+	for i, hop := range lr.Hops {
+		fmt.Printf("hop %d: %v (%v) in %v\n", i+1, hop.Addr, hop.ID, hop.Latency)
 	}
 }
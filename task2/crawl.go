@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Kinds of inconsistencies a crawl can find.
+const (
+	// IssueBroken: a node could not be reached or did not answer.
+	IssueBroken = "broken"
+	// IssueDuplicate: the successor walk came back to a node other than
+	// the start, or two nodes share an identifier.
+	IssueDuplicate = "duplicate"
+	// IssueAsymmetric: a node's successor does not name it as predecessor.
+	IssueAsymmetric = "asymmetric"
+	// IssueOrder: the walk wrapped around the identifier circle more than
+	// once, so successors skip over or go back past other members.
+	IssueOrder = "order"
+)
+
+// CrawlNode is a ring member as seen by the crawler.
+type CrawlNode struct {
+	Addr        string
+	ID          Key
+	Successor   string
+	Predecessor string
+}
+
+type CrawlIssue struct {
+	Kind   string
+	Addr   string
+	Detail string
+}
+
+// CrawlResult lists the members in successor order, starting with the node
+// the crawl started from.
+type CrawlResult struct {
+	Start    string
+	Bits     uint
+	Nodes    []CrawlNode
+	Issues   []CrawlIssue
+	Complete bool
+}
+
+// Crawl walks the ring from start along successor pointers until it comes
+// back around, visiting at most limit nodes, and checks the pointers it sees
+// for consistency. Every RPC is bounded by timeout.
+func Crawl(ctx context.Context, caller Caller, start string, limit int, timeout time.Duration) (CrawlResult, error) {
+	cr := CrawlResult{Start: start}
+
+	call := func(addr, proc string, reply interface{}) error {
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+
+		return caller.CallContext(ctx, addr, proc, "", reply)
+	}
+
+	var rr RingResp
+	if err := call(start, "Ring", &rr); err != nil {
+		return cr, err
+	}
+	cr.Bits = rr.Bits
+
+	// Other members name the start node by its own address, which may
+	// differ from the one we were given.
+	if rr.Addr != "" {
+		start, cr.Start = rr.Addr, rr.Addr
+	}
+
+	index := make(map[string]int)
+	ids := make(map[Key]string)
+	prev := ""
+	for addr := start; len(cr.Nodes) < limit; {
+		if i, ok := index[addr]; ok {
+			if i == 0 {
+				cr.Complete = true
+			} else {
+				cr.issue(IssueDuplicate, addr, "successor walk loops back to (%v) instead of (%v)", addr, start)
+			}
+			break
+		}
+
+		cn := CrawlNode{Addr: addr, ID: HashKey(addr, cr.Bits)}
+
+		var gsr GetSuccResp
+		if err := call(addr, "GetSucc", &gsr); err != nil {
+			if prev != "" {
+				cr.issue(IssueBroken, addr, "successor of (%v) does not answer: %v", prev, err)
+			} else {
+				cr.issue(IssueBroken, addr, "%v", err)
+			}
+			break
+		}
+		cn.Successor = gsr.Addr
+
+		var gpr GetPredResp
+		if err := call(addr, "GetPred", &gpr); err != nil {
+			cr.issue(IssueBroken, addr, "%v", err)
+			break
+		}
+		cn.Predecessor = gpr.Addr
+
+		if other, ok := ids[cn.ID]; ok {
+			cr.issue(IssueDuplicate, addr, "shares ID (%v) with (%v)", cn.ID, other)
+		}
+		ids[cn.ID] = addr
+
+		index[addr] = len(cr.Nodes)
+		cr.Nodes = append(cr.Nodes, cn)
+		prev, addr = addr, cn.Successor
+	}
+
+	if !cr.Complete {
+		return cr, nil
+	}
+
+	wraps := 0
+	for i, cn := range cr.Nodes {
+		succ := cr.Nodes[(i+1)%len(cr.Nodes)]
+		if succ.Predecessor != cn.Addr {
+			cr.issue(IssueAsymmetric, succ.Addr, "predecessor is (%v), but (%v) names it as successor", succ.Predecessor, cn.Addr)
+		}
+		if succ.ID.Cmp(cn.ID) <= 0 {
+			wraps++
+		}
+	}
+	if wraps > 1 {
+		cr.issue(IssueOrder, start, "successor walk wraps around the identifier circle %d times", wraps)
+	}
+
+	return cr, nil
+}
+
+func (cr *CrawlResult) issue(kind, addr, format string, args ...interface{}) {
+	cr.Issues = append(cr.Issues, CrawlIssue{Kind: kind, Addr: addr, Detail: fmt.Sprintf(format, args...)})
+}
+
+// WriteText prints the members one per line, followed by the issues.
+func (cr CrawlResult) WriteText(w io.Writer) error {
+	for _, cn := range cr.Nodes {
+		if _, err := fmt.Fprintf(w, "%v (%v) -> %v, pred %v\n", cn.Addr, cn.ID, cn.Successor, cn.Predecessor); err != nil {
+			return err
+		}
+	}
+
+	state := "incomplete"
+	if cr.Complete {
+		state = "complete"
+	}
+	fmt.Fprintf(w, "%d nodes, ring %v, %d issues\n", len(cr.Nodes), state, len(cr.Issues))
+
+	for _, issue := range cr.Issues {
+		if _, err := fmt.Fprintf(w, "%v: %v: %v\n", issue.Kind, issue.Addr, issue.Detail); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (cr CrawlResult) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(cr)
+}
+
+// WriteDOT draws successor pointers as solid edges and predecessor pointers
+// as dashed ones. Nodes with issues are drawn in red.
+func (cr CrawlResult) WriteDOT(w io.Writer) error {
+	bad := make(map[string]bool)
+	for _, issue := range cr.Issues {
+		bad[issue.Addr] = true
+	}
+
+	fmt.Fprintln(w, "digraph ring {")
+	for _, cn := range cr.Nodes {
+		color := "black"
+		if bad[cn.Addr] {
+			color = "red"
+		}
+		fmt.Fprintf(w, "\t%q [label=%q, color=%v];\n", cn.Addr, fmt.Sprintf("%v\n%v", cn.Addr, cn.ID), color)
+	}
+	for _, cn := range cr.Nodes {
+		fmt.Fprintf(w, "\t%q -> %q;\n", cn.Addr, cn.Successor)
+		fmt.Fprintf(w, "\t%q -> %q [style=dashed];\n", cn.Addr, cn.Predecessor)
+	}
+	_, err := fmt.Fprintln(w, "}")
+
+	return err
+}
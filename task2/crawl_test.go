@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// pointerCaller answers GetSucc and GetPred from fixed pointers. Nodes
+// without pointers do not answer.
+type pointerCaller struct {
+	succ map[string]string
+	pred map[string]string
+}
+
+func (pc pointerCaller) Call(addr, proc string, args interface{}, reply interface{}) error {
+	succ, ok := pc.succ[addr]
+	if !ok {
+		return &net.OpError{Op: "dial", Net: "tcp", Err: net.ErrClosed}
+	}
+
+	switch proc {
+	case "Ring":
+		reply.(*RingResp).Bits = defaultBits
+		reply.(*RingResp).Addr = addr
+	case "GetSucc":
+		reply.(*GetSuccResp).Addr = succ
+	case "GetPred":
+		reply.(*GetPredResp).Addr = pc.pred[addr]
+	}
+
+	return nil
+}
+
+func (pc pointerCaller) CallContext(ctx context.Context, addr, proc string, args interface{}, reply interface{}) error {
+	return pc.Call(addr, proc, args, reply)
+}
+
+// sortedRing returns n addresses sorted by ID, so that each one's successor
+// is the next.
+func sortedRing(n int) []string {
+	addrs := make([]string, n)
+	for i := range addrs {
+		addrs[i] = "localhost:" + string(rune('a'+i))
+	}
+	sort.Slice(addrs, func(i, j int) bool {
+		return HashKey(addrs[i], defaultBits).Cmp(HashKey(addrs[j], defaultBits)) < 0
+	})
+
+	return addrs
+}
+
+func consistent(addrs []string) pointerCaller {
+	pc := pointerCaller{succ: make(map[string]string), pred: make(map[string]string)}
+	for i, addr := range addrs {
+		pc.succ[addr] = addrs[(i+1)%len(addrs)]
+		pc.pred[addrs[(i+1)%len(addrs)]] = addr
+	}
+
+	return pc
+}
+
+func TestCrawl(t *testing.T) {
+	r := sortedRing(5)
+
+	tests := []struct {
+		name     string
+		mutate   func(pc pointerCaller)
+		nodes    int
+		complete bool
+		issues   []string
+	}{
+		{"consistent", func(pc pointerCaller) {}, 5, true, nil},
+		{"broken", func(pc pointerCaller) { delete(pc.succ, r[2]) }, 2, false, []string{IssueBroken}},
+		{"asymmetric", func(pc pointerCaller) { pc.pred[r[3]] = r[1] }, 5, true, []string{IssueAsymmetric}},
+		{"loop", func(pc pointerCaller) { pc.succ[r[3]] = r[1] }, 4, false, []string{IssueDuplicate}},
+		{"order", func(pc pointerCaller) {
+			// r0 -> r2 -> r1 -> r3 -> r4 -> r0, predecessors fixed up.
+			pc.succ[r[0]], pc.succ[r[2]], pc.succ[r[1]] = r[2], r[1], r[3]
+			pc.pred[r[2]], pc.pred[r[1]], pc.pred[r[3]] = r[0], r[2], r[1]
+		}, 5, true, []string{IssueOrder}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pc := consistent(r)
+			test.mutate(pc)
+
+			cr, err := Crawl(context.Background(), pc, r[0], 100, time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var kinds []string
+			for _, issue := range cr.Issues {
+				kinds = append(kinds, issue.Kind)
+			}
+
+			if len(cr.Nodes) != test.nodes || cr.Complete != test.complete || strings.Join(kinds, ",") != strings.Join(test.issues, ",") {
+				t.Errorf("Expected (%v) nodes, complete (%v) and issues (%v), found (%v), (%v) and (%v)", test.nodes, test.complete, test.issues, len(cr.Nodes), cr.Complete, cr.Issues)
+			}
+		})
+	}
+}
+
+func TestCrawlOutput(t *testing.T) {
+	r := sortedRing(3)
+	cr, err := Crawl(context.Background(), consistent(r), r[0], 100, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, write := range []func(CrawlResult, *bytes.Buffer) error{
+		func(cr CrawlResult, b *bytes.Buffer) error { return cr.WriteText(b) },
+		func(cr CrawlResult, b *bytes.Buffer) error { return cr.WriteJSON(b) },
+		func(cr CrawlResult, b *bytes.Buffer) error { return cr.WriteDOT(b) },
+	} {
+		var b bytes.Buffer
+		if err := write(cr, &b); err != nil {
+			t.Fatal(err)
+		}
+		for _, addr := range r {
+			if !strings.Contains(b.String(), addr) {
+				t.Errorf("Expected (%v) in output, found (%v)", addr, b.String())
+			}
+		}
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// PeerState is what the failure detector believes about a peer.
+type PeerState int
+
+const (
+	// PeerAlive peers answered their latest round trip.
+	PeerAlive PeerState = iota
+	// PeerSuspect peers missed at least one round trip.
+	PeerSuspect
+	// PeerDead peers missed FailAfter round trips in a row. They are
+	// purged from the routing state.
+	PeerDead
+)
+
+func (s PeerState) String() string {
+	switch s {
+	case PeerAlive:
+		return "alive"
+	case PeerSuspect:
+		return "suspect"
+	case PeerDead:
+		return "dead"
+	}
+
+	return fmt.Sprintf("PeerState(%d)", int(s))
+}
+
+func (s PeerState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+func (s *PeerState) UnmarshalText(text []byte) error {
+	for _, st := range []PeerState{PeerAlive, PeerSuspect, PeerDead} {
+		if st.String() == string(text) {
+			*s = st
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unknown peer state (%s)", text)
+}
+
+// defaultFailAfter is how many round trips in a row a peer may miss before
+// it is declared dead.
+const defaultFailAfter = 3
+
+// subscriberBuffer is how many events a subscriber may fall behind before
+// events are dropped for it.
+const subscriberBuffer = 16
+
+// PeerStatus is the failure detector's view of one peer.
+type PeerStatus struct {
+	Addr  string
+	State PeerState
+	// Failures counts the round trips missed in a row.
+	Failures int
+	LastSeen time.Time
+}
+
+// MemberEvent reports that the failure detector changed its mind about a
+// peer.
+type MemberEvent struct {
+	Addr  string
+	Prev  PeerState
+	State PeerState
+	Time  time.Time
+}
+
+// detector tracks the state of the peers the node routes through: its
+// predecessor, successors and fingers. It learns from every round trip the
+// node makes, and heartbeat pings the peers that are not otherwise used.
+type detector struct {
+	mu        sync.Mutex
+	failAfter int
+	peers     map[string]*PeerStatus
+	subs      map[chan MemberEvent]bool
+}
+
+func newDetector(failAfter int) *detector {
+	return &detector{
+		failAfter: failAfter,
+		peers:     make(map[string]*PeerStatus),
+		subs:      make(map[chan MemberEvent]bool),
+	}
+}
+
+// watch starts tracking the given peers and forgets every other one. New
+// peers start out alive.
+func (d *detector) watch(addrs []string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	watched := make(map[string]bool)
+	for _, addr := range addrs {
+		watched[addr] = true
+		if _, ok := d.peers[addr]; !ok {
+			d.peers[addr] = &PeerStatus{Addr: addr, State: PeerAlive, LastSeen: time.Now()}
+		}
+	}
+
+	for addr := range d.peers {
+		if !watched[addr] {
+			delete(d.peers, addr)
+		}
+	}
+}
+
+// observe records the outcome of a round trip to addr. It returns the
+// resulting state of the peer, and the event if the state changed. Peers
+// that are not watched are ignored.
+func (d *detector) observe(addr string, failed bool) (PeerState, *MemberEvent) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	ps, ok := d.peers[addr]
+	if !ok {
+		return PeerAlive, nil
+	}
+
+	prev := ps.State
+	if failed {
+		ps.Failures++
+		ps.State = PeerSuspect
+		if ps.Failures >= d.failAfter {
+			ps.State = PeerDead
+		}
+	} else {
+		ps.Failures = 0
+		ps.State = PeerAlive
+		ps.LastSeen = time.Now()
+	}
+
+	if ps.State == prev {
+		return ps.State, nil
+	}
+
+	return ps.State, &MemberEvent{Addr: addr, Prev: prev, State: ps.State, Time: time.Now()}
+}
+
+// report returns the tracked peers sorted by address.
+func (d *detector) report() []PeerStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var peers []PeerStatus
+	for _, ps := range d.peers {
+		peers = append(peers, *ps)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].Addr < peers[j].Addr })
+
+	return peers
+}
+
+// subscribe returns a channel receiving every membership event from now on
+// and a function that ends the subscription. Events are dropped for
+// subscribers that fall behind.
+func (d *detector) subscribe() (<-chan MemberEvent, func()) {
+	ch := make(chan MemberEvent, subscriberBuffer)
+
+	d.mu.Lock()
+	d.subs[ch] = true
+	d.mu.Unlock()
+
+	return ch, func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+
+		delete(d.subs, ch)
+	}
+}
+
+func (d *detector) publish(ev MemberEvent) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for ch := range d.subs {
+		select {
+		case ch <- ev:
+		default:
+			log.Printf("dropping membership event of (%v) for a slow subscriber", ev.Addr)
+		}
+	}
+}
+
+// unreachable reports whether err means the peer could not be reached, as
+// opposed to the peer answering with an error.
+func unreachable(err error) bool {
+	return isDialErr(err) || errors.Is(err, ErrTimeout) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// observe feeds the outcome of a round trip to addr into the failure
+// detector, purging addr from the routing state once it is dead.
+func (n *Node) observe(addr string, err error) {
+	if addr == n.Addr {
+		return
+	}
+
+	state, ev := n.detector.observe(addr, unreachable(err))
+
+	// A dead peer may be handed to us again by a neighbour that has not
+	// noticed yet, so purge it on every failure and not just once.
+	if state == PeerDead {
+		n.purge(addr)
+	}
+
+	if ev != nil {
+		log.Printf("peer (%v) of ID (%v) is %v, was %v", addr, n.hash(addr), ev.State, ev.Prev)
+		n.detector.publish(*ev)
+	}
+}
+
+// purge removes a dead peer from the finger table, the successor list and
+// the predecessor pointer.
+func (n *Node) purge(addr string) {
+	n.mufing.Lock()
+	var table []string
+	for i, f := range n.fingerTable {
+		if f != addr {
+			continue
+		}
+		// The table is copy on write.
+		if table == nil {
+			table = append([]string(nil), n.fingerTable...)
+		}
+		table[i] = ""
+	}
+	if table != nil {
+		n.fingerTable = table
+	}
+	n.mufing.Unlock()
+
+	if contains(n.getSuccList(), addr) {
+		n.succFailed(addr)
+	}
+
+	n.muroute.Lock()
+	if n.Predecessor == addr {
+		n.Predecessor = n.Addr
+	}
+	n.muroute.Unlock()
+}
+
+// neighbours returns the peers the node routes through.
+func (n *Node) neighbours() []string {
+	seen := map[string]bool{n.Addr: true, "": true}
+
+	var addrs []string
+	for _, addr := range append(append([]string{n.getPred()}, n.getSuccList()...), n.fingers()...) {
+		if !seen[addr] {
+			seen[addr] = true
+			addrs = append(addrs, addr)
+		}
+	}
+
+	return addrs
+}
+
+// heartbeat pings every neighbour once. The outcome reaches the failure
+// detector through call.
+func (n *Node) heartbeat(ctx context.Context, caller Caller) {
+	addrs := n.neighbours()
+	n.detector.watch(addrs)
+
+	var wg sync.WaitGroup
+	for _, addr := range addrs {
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+
+			var empty string
+			n.call(ctx, caller, addr, "Ping", empty, &empty)
+		}(addr)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestDetector(t *testing.T) {
+	d := newDetector(3)
+	d.watch([]string{"a", "b"})
+
+	events, cancel := d.subscribe()
+	defer cancel()
+
+	steps := []struct {
+		addr   string
+		failed bool
+		want   PeerState
+		event  bool
+	}{
+		{"a", false, PeerAlive, false},
+		{"a", true, PeerSuspect, true},
+		{"a", true, PeerSuspect, false},
+		{"a", false, PeerAlive, true},
+		{"a", true, PeerSuspect, true},
+		{"a", true, PeerSuspect, false},
+		{"a", true, PeerDead, true},
+		{"a", true, PeerDead, false},
+		{"a", false, PeerAlive, true},
+		{"c", true, PeerAlive, false},
+	}
+
+	for i, s := range steps {
+		state, ev := d.observe(s.addr, s.failed)
+		if state != s.want || (ev != nil) != s.event {
+			t.Errorf("step %d: Expected (%v, %v), found (%v, %v)", i, s.want, s.event, state, ev)
+		}
+		if ev != nil {
+			d.publish(*ev)
+			if got := <-events; got.Addr != s.addr || got.State != s.want {
+				t.Errorf("step %d: Expected event of (%v) being %v, found (%v)", i, s.addr, s.want, got)
+			}
+		}
+	}
+
+	d.watch([]string{"b"})
+	if peers := d.report(); len(peers) != 1 || peers[0].Addr != "b" {
+		t.Errorf("Expected only (%v) to be watched, found (%v)", "b", peers)
+	}
+}
+
+func TestUnreachable(t *testing.T) {
+	cases := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{errors.New("rpc: can't find method"), false},
+		{&net.OpError{Op: "dial", Err: errors.New("refused")}, true},
+		{ErrTimeout, true},
+	}
+
+	for _, c := range cases {
+		if got := unreachable(c.err); got != c.want {
+			t.Errorf("unreachable(%v): Expected (%v), found (%v)", c.err, c.want, got)
+		}
+	}
+}
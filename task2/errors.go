@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"net/rpc"
+	"strings"
+)
+
+// ErrorCode classifies the errors returned by the RPC methods of Node.
+type ErrorCode string
+
+const (
+	// CodeNotFound means the requested file is not stored on the node.
+	CodeNotFound ErrorCode = "NotFound"
+	// CodeNotResponsible means the key belongs to another node.
+	CodeNotResponsible ErrorCode = "NotResponsible"
+	// CodeQuotaExceeded means the node is out of space, see QuotaError.
+	CodeQuotaExceeded ErrorCode = "QuotaExceeded"
+	// CodeChecksumMismatch means content did not match its checksum.
+	CodeChecksumMismatch ErrorCode = "ChecksumMismatch"
+	// CodeUnavailable means a node needed to serve the request could not
+	// be reached.
+	CodeUnavailable ErrorCode = "Unavailable"
+	// CodeInternal covers every other failure.
+	CodeInternal ErrorCode = "Internal"
+)
+
+var errorCodes = []ErrorCode{CodeNotFound, CodeNotResponsible, CodeQuotaExceeded, CodeChecksumMismatch, CodeUnavailable, CodeInternal}
+
+// Error is the error returned by every RPC method of Node. net/rpc only
+// carries the text of an error, so Error renders the code first and
+// decodeError restores it on the caller's side.
+type Error struct {
+	Code    ErrorCode
+	Message string
+	// Addr is the node to try instead, for CodeNotResponsible.
+	Addr string
+}
+
+// redirectPrefix introduces the Addr of an Error in its text.
+const redirectPrefix = "; try "
+
+func (e *Error) Error() string {
+	if e.Addr != "" {
+		return string(e.Code) + ": " + e.Message + redirectPrefix + e.Addr
+	}
+
+	return string(e.Code) + ": " + e.Message
+}
+
+// Is matches an *Error against the local errors of the same meaning, so that
+// errors.Is(err, ErrChecksumMismatch) holds no matter which side of a call
+// the checksum failed on. An *Error target without a message matches any
+// error of its code.
+func (e *Error) Is(target error) bool {
+	switch target {
+	case ErrChecksumMismatch:
+		return e.Code == CodeChecksumMismatch
+	case fs.ErrNotExist:
+		return e.Code == CodeNotFound
+	}
+
+	var t *Error
+	return errors.As(target, &t) && t.Code == e.Code && t.Message == ""
+}
+
+// redirect returns the node err tells to try instead, if any.
+func redirect(err error) (string, bool) {
+	var e *Error
+	if errors.As(err, &e) && e.Code == CodeNotResponsible && e.Addr != "" {
+		return e.Addr, true
+	}
+
+	return "", false
+}
+
+// codeOf classifies err. nil has no code.
+func codeOf(err error) ErrorCode {
+	var e *Error
+	var qe *QuotaError
+	switch {
+	case err == nil:
+		return ""
+	case errors.As(err, &e):
+		return e.Code
+	case errors.As(err, &qe):
+		return CodeQuotaExceeded
+	case errors.Is(err, ErrChecksumMismatch):
+		return CodeChecksumMismatch
+	case errors.Is(err, fs.ErrNotExist):
+		return CodeNotFound
+	case unreachable(err):
+		return CodeUnavailable
+	}
+
+	return CodeInternal
+}
+
+// rpcError turns err into the *Error an RPC method returns.
+func rpcError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	}
+
+	return &Error{Code: codeOf(err), Message: err.Error()}
+}
+
+// decodeError restores the *Error a remote RPC method returned. Other errors
+// are returned unchanged.
+func decodeError(err error) error {
+	var se rpc.ServerError
+	if !errors.As(err, &se) {
+		return err
+	}
+
+	code, msg, ok := strings.Cut(string(se), ": ")
+	if !ok {
+		return err
+	}
+
+	for _, c := range errorCodes {
+		if ErrorCode(code) != c {
+			continue
+		}
+
+		var addr string
+		if i := strings.LastIndex(msg, redirectPrefix); i >= 0 && c == CodeNotResponsible {
+			msg, addr = msg[:i], msg[i+len(redirectPrefix):]
+		}
+		return &Error{Code: c, Message: msg, Addr: addr}
+	}
+
+	return err
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/rpc"
+	"testing"
+)
+
+func TestErrorCodes(t *testing.T) {
+	cases := []struct {
+		err  error
+		want ErrorCode
+	}{
+		{nil, ""},
+		{&QuotaError{Resource: QuotaFiles}, CodeQuotaExceeded},
+		{fmt.Errorf("upload: %w", ErrChecksumMismatch), CodeChecksumMismatch},
+		{&fs.PathError{Op: "open", Path: "a.txt", Err: fs.ErrNotExist}, CodeNotFound},
+		{&net.OpError{Op: "dial", Err: errors.New("refused")}, CodeUnavailable},
+		{&Error{Code: CodeNotResponsible, Message: "key (7) is elsewhere", Addr: "localhost:8081"}, CodeNotResponsible},
+		{errors.New("disk on fire"), CodeInternal},
+	}
+
+	for _, c := range cases {
+		if got := codeOf(c.err); got != c.want {
+			t.Errorf("codeOf(%v): Expected (%v), found (%v)", c.err, c.want, got)
+		}
+
+		// Every code survives the trip through net/rpc, which only
+		// carries the text of an error.
+		if c.err == nil {
+			continue
+		}
+		sent := rpcError(c.err)
+		got := decodeError(rpc.ServerError(sent.Error()))
+		if codeOf(got) != c.want || got.Error() != sent.Error() {
+			t.Errorf("decodeError(%v): Expected (%v), found (%v)", sent, sent, got)
+		}
+		if want, _ := redirect(sent); want != "" {
+			if addr, _ := redirect(got); addr != want {
+				t.Errorf("decodeError(%v): Expected a redirect to (%v), found (%v)", sent, want, addr)
+			}
+		}
+	}
+
+	if err := decodeError(rpc.ServerError("rpc: can't find method Node.Nope")); codeOf(err) != CodeInternal {
+		t.Errorf("Expected a plain server error to stay internal, found (%v)", codeOf(err))
+	}
+
+	e := &Error{Code: CodeChecksumMismatch, Message: "a.txt"}
+	if !errors.Is(e, ErrChecksumMismatch) || !errors.Is(e, &Error{Code: CodeChecksumMismatch}) || errors.Is(e, fs.ErrNotExist) {
+		t.Errorf("Expected (%v) to match checksum mismatches only", e)
+	}
+}
+
+func TestErrorOverRPC(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	n := NewNode(ln.Addr().String(), Config{Store: NewMemStore()})
+	srv := rpc.NewServer()
+	if err := srv.RegisterName("Node", n); err != nil {
+		t.Fatal(err)
+	}
+	go srv.Accept(ln)
+
+	rc := NewRPCCaller()
+	defer rc.Close()
+
+	var rfr RetrieveFileResp
+	err = rc.Call(n.Addr, "RetrieveFile", RetrieveFileReq{Filename: "missing.txt", ID: n.hash("missing.txt")}, &rfr)
+
+	var e *Error
+	if !errors.As(err, &e) || e.Code != CodeNotFound {
+		t.Errorf("Expected a (%v) error, found (%v)", CodeNotFound, err)
+	}
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"sort"
+	"time"
+)
+
+// defaultListLimit and maxListLimit bound the number of files on a page of
+// ListFiles.
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
+type DeleteFileReq struct {
+	Filename string
+	// Owner is the namespace of the file, see UploadFileReq. It is taken
+	// on trust, see ownerPrefix.
+	Owner string
+	ID    Key
+	// Replica deletes the replica held by a successor of the responsible
+	// node instead of the file itself.
+	Replica bool
+	// Deleted is when the responsible node deleted the file. It is set on
+	// the deletion of replicas too, but not when replicas are dropped, see
+	// dropReplicas.
+	Deleted time.Time
+}
+
+// tombstoneTTL is how long a deletion is remembered. Copies of the file
+// that missed it for longer come back.
+const tombstoneTTL = 24 * time.Hour
+
+// tombstone records the deletion of a file, so that copies of it pushed by
+// nodes that missed the deletion are not taken back in, see commitUpload.
+type tombstone struct {
+	Name    string
+	Deleted time.Time
+}
+
+type StatFileReq struct {
+	Filename string
+	// Owner is the namespace of the file, see UploadFileReq.
+	Owner string
+	ID    Key
+}
+
+// FileStat describes a file stored in the ring.
+type FileStat struct {
+	Name string
+	// Owner is the namespace of the file, see UploadFileReq.
+	Owner    string
+	ID       Key
+	Size     int64
+	Checksum string
+	// Node is the node responsible for the file.
+	Node string
+	// Stored is when the node stored its copy.
+	Stored time.Time
+}
+
+type ListFilesReq struct {
+	// Owner restricts the listing to the files of one namespace, see
+	// UploadFileReq. It is taken on trust, see ownerPrefix.
+	Owner string
+	// From is the smallest key to list.
+	From Key
+	// To is the largest key to list, only used by LocalFiles.
+	To    Key
+	Limit int
+}
+
+type ListFilesResp struct {
+	// Files are sorted by key.
+	Files []FileStat
+	// More is set when the listing was cut short at Limit files. Next is
+	// the From of the following page then.
+	More bool
+	Next Key
+}
+
+// listLimit returns the page size to use for a requested limit.
+func listLimit(limit int) int {
+	if limit <= 0 {
+		return defaultListLimit
+	}
+	if limit > maxListLimit {
+		return maxListLimit
+	}
+
+	return limit
+}
+
+// deleteFile removes the file of key id stored under name, or our replica of
+// it, along with what is left of an upload of it. A missing replica is not
+// an error, so that deletions can be retried. Unless deleted is zero, a
+// tombstone is left behind, even for a file we do not hold yet.
+func (n *Node) deleteFile(id Key, name string, replica bool, deleted time.Time) error {
+	n.mufile.Lock()
+	defer n.mufile.Unlock()
+
+	table := n.fileTable
+	if replica {
+		table = n.replicaTable
+	}
+
+	n.removeSpool(id)
+	n.usage.release(id)
+	if !deleted.IsZero() {
+		n.tombstones[id] = tombstone{Name: name, Deleted: deleted}
+	}
+
+	// The name is checked too, so that a file of another namespace
+	// is not deleted by its key alone.
+	if table[id] != name {
+		if replica {
+			return nil
+		}
+		return notStored(name, id, n.Addr)
+	}
+
+	if err := n.store.Delete(name); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	n.usage.removed(name)
+	delete(table, id)
+
+	return nil
+}
+
+// expireTombstones forgets the deletions older than tombstoneTTL.
+func (n *Node) expireTombstones() {
+	n.mufile.Lock()
+	defer n.mufile.Unlock()
+
+	for id, ts := range n.tombstones {
+		if time.Since(ts.Deleted) > tombstoneTTL {
+			delete(n.tombstones, id)
+		}
+	}
+}
+
+// notStored is the error for a file of key id missing from addr.
+func notStored(name string, id Key, addr string) error {
+	return &Error{Code: CodeNotFound, Message: fmt.Sprintf("file (%v) of key (%v) is not stored on (%v)", name, id, addr)}
+}
+
+// deleteReplicas removes the replicas of a deleted file from our successors.
+// Every successor is asked, not just the current replica targets, since
+// replicas outlive changes of the successor list.
+func (n *Node) deleteReplicas(ctx context.Context, df DeleteFileReq, caller Caller) {
+	df.Replica = true
+	for _, addr := range n.getSuccList() {
+		if addr == n.Addr {
+			continue
+		}
+
+		if err := n.call(ctx, caller, addr, "DeleteFile", df, new(string)); err != nil {
+			log.Printf("deleting replica of file (%v) on (%v): %v", df.Filename, addr, err)
+		}
+	}
+}
+
+// statFile describes the file of key id we are responsible for.
+func (n *Node) statFile(id Key) (FileStat, error) {
+	n.mufile.Lock()
+	defer n.mufile.Unlock()
+
+	name, ok := n.fileTable[id]
+	if !ok {
+		return FileStat{}, notStored("", id, n.Addr)
+	}
+
+	fi, err := n.store.Stat(name)
+	if err != nil {
+		return FileStat{}, err
+	}
+
+	owner, filename := splitFileName(name)
+	return FileStat{Name: filename, Owner: owner, ID: id, Size: fi.Size, Checksum: fi.Checksum, Node: n.Addr, Stored: fi.ModTime}, nil
+}
+
+// localFiles lists the files of lf.Owner we are responsible for whose keys
+// fall into [lf.From, lf.To].
+func (n *Node) localFiles(lf ListFilesReq) ListFilesResp {
+	var ids []Key
+	for fileid, name := range n.files() {
+		if owner, _ := splitFileName(name); owner != lf.Owner {
+			continue
+		}
+		if lf.From.Cmp(fileid) <= 0 && fileid.Cmp(lf.To) <= 0 {
+			ids = append(ids, fileid)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i].Cmp(ids[j]) < 0 })
+
+	var resp ListFilesResp
+	if limit := listLimit(lf.Limit); len(ids) > limit {
+		resp.More, resp.Next = true, ids[limit]
+		ids = ids[:limit]
+	}
+
+	for _, fileid := range ids {
+		fs, err := n.statFile(fileid)
+		if err != nil {
+			// Deleted in the meantime.
+			continue
+		}
+		resp.Files = append(resp.Files, fs)
+	}
+
+	return resp
+}
+
+// listFiles collects a page of the files stored in the ring, in key order. It
+// walks the nodes responsible for the keys from lf.From on, asking each for
+// its share, until the page is full or the end of the key space is reached.
+func (n *Node) listFiles(ctx context.Context, lf ListFilesReq, caller Caller) (ListFilesResp, error) {
+	limit := listLimit(lf.Limit)
+	last := KeyFromInt(new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), n.bits), big.NewInt(1)), n.bits)
+
+	var resp ListFilesResp
+	from := lf.From
+	for {
+		lr := n.find(ctx, from, caller)
+		if lr.Addr == "" {
+			return resp, lookupFailed(from)
+		}
+
+		// The owner holds the keys from `from` up to its ID, or up to
+		// the end of the key space if its range wraps around.
+		to := lr.ID
+		if to.Cmp(from) < 0 {
+			to = last
+		}
+
+		var page ListFilesResp
+		req := ListFilesReq{Owner: lf.Owner, From: from, To: to, Limit: limit - len(resp.Files)}
+		if err := n.call(ctx, caller, lr.Addr, "LocalFiles", req, &page); err != nil {
+			return resp, err
+		}
+
+		resp.Files = append(resp.Files, page.Files...)
+		if page.More {
+			resp.More, resp.Next = true, page.Next
+			return resp, nil
+		}
+		if to == last {
+			return resp, nil
+		}
+
+		from = to.Add(big.NewInt(1), n.bits)
+		if len(resp.Files) == limit {
+			resp.More, resp.Next = true, from
+			return resp, nil
+		}
+	}
+}
+
+func (n *Node) DeleteFile(df DeleteFileReq, empty *string) error {
+	name, err := n.resolveName(df.Owner, df.Filename, df.ID)
+	if err != nil {
+		return rpcError(err)
+	}
+
+	if df.Replica {
+		return rpcError(n.deleteFile(df.ID, name, true, df.Deleted))
+	}
+
+	ctx := context.Background()
+	if err := n.checkResponsible(ctx, df.ID, n.caller); err != nil {
+		return err
+	}
+
+	df.Deleted = time.Now()
+	err = n.deleteFile(df.ID, name, false, df.Deleted)
+	if err != nil && codeOf(err) != CodeNotFound {
+		return rpcError(err)
+	}
+
+	if serr := n.saveState(); serr != nil {
+		log.Println("saving node state:", serr)
+	}
+
+	// Replicas are cleaned up even if our copy was missing, they would be
+	// promoted again otherwise.
+	n.deleteReplicas(ctx, df, n.caller)
+
+	return rpcError(err)
+}
+
+func (n *Node) StatFile(sf StatFileReq, fs *FileStat) error {
+	name, err := n.resolveName(sf.Owner, sf.Filename, sf.ID)
+	if err != nil {
+		return rpcError(err)
+	}
+
+	if err := n.checkResponsible(context.Background(), sf.ID, n.caller); err != nil {
+		return err
+	}
+
+	st, err := n.statFile(sf.ID)
+	if codeOf(err) == CodeNotFound || err == nil && fileName(st.Owner, st.Name) != name {
+		err = notStored(name, sf.ID, n.Addr)
+	}
+	if err != nil {
+		return rpcError(err)
+	}
+
+	*fs = st
+	return nil
+}
+
+// LocalFiles lists the files of this node, see localFiles.
+func (n *Node) LocalFiles(lf ListFilesReq, lfr *ListFilesResp) error {
+	*lfr = n.localFiles(lf)
+	return nil
+}
+
+// ListFiles lists the files of the whole ring a page at a time, see
+// listFiles.
+func (n *Node) ListFiles(lf ListFilesReq, lfr *ListFilesResp) error {
+	resp, err := n.listFiles(context.Background(), lf, n.caller)
+	if err != nil {
+		return rpcError(err)
+	}
+
+	*lfr = resp
+	return nil
+}
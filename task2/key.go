@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+)
+
+// Key is an identifier on the Chord circle: an unsigned big-endian number of
+// up to 160 bits, the size of a SHA-1 digest. A ring of m bits only uses the
+// low m bits of a Key.
+type Key [sha1.Size]byte
+
+// maxBits is the widest identifier space supported.
+const maxBits = sha1.Size * 8
+
+// HashKey maps s onto a ring of the given bit width. Rings of up to 64 bits
+// take the first 8 bytes of the digest modulo 2^bits, as the uint64 IDs
+// did, so that nodes keep their IDs and data directories. Wider rings take
+// the low bits of the whole digest.
+func HashKey(s string, bits uint) Key {
+	sum := sha1.Sum([]byte(s))
+	if bits <= 64 {
+		return KeyFromInt(new(big.Int).SetUint64(binary.BigEndian.Uint64(sum[:])), bits)
+	}
+
+	return Key(sum).mask(bits)
+}
+
+// KeyFromInt converts i, reduced modulo 2^bits, into a Key.
+func KeyFromInt(i *big.Int, bits uint) Key {
+	var k Key
+	new(big.Int).Mod(i, new(big.Int).Lsh(big.NewInt(1), bits)).FillBytes(k[:])
+	return k
+}
+
+// ParseKey parses a decimal identifier of a ring of the given bit width.
+func ParseKey(s string, bits uint) (Key, error) {
+	i, ok := new(big.Int).SetString(s, 10)
+	if !ok || i.Sign() < 0 || i.BitLen() > int(bits) {
+		return Key{}, fmt.Errorf("invalid key (%v) for a ring of %d bits", s, bits)
+	}
+
+	return KeyFromInt(i, bits), nil
+}
+
+func (k Key) Int() *big.Int {
+	return new(big.Int).SetBytes(k[:])
+}
+
+func (k Key) String() string {
+	return k.Int().String()
+}
+
+// MarshalText encodes the key in decimal so it can be used as a JSON map key.
+func (k Key) MarshalText() ([]byte, error) {
+	return []byte(k.String()), nil
+}
+
+func (k *Key) UnmarshalText(text []byte) error {
+	i, ok := new(big.Int).SetString(string(text), 10)
+	if !ok {
+		return fmt.Errorf("invalid key %q", text)
+	}
+
+	*k = KeyFromInt(i, maxBits)
+	return nil
+}
+
+func (k Key) Cmp(o Key) int {
+	return bytes.Compare(k[:], o[:])
+}
+
+// Add returns (k + x) mod 2^bits.
+func (k Key) Add(x *big.Int, bits uint) Key {
+	return KeyFromInt(new(big.Int).Add(k.Int(), x), bits)
+}
+
+// fingerStart returns (k + 2^i) mod 2^bits, the start of the i-th finger.
+func (k Key) fingerStart(i, bits uint) Key {
+	return k.Add(new(big.Int).Lsh(big.NewInt(1), i), bits)
+}
+
+// mask clears every bit above the low bits ones.
+func (k Key) mask(bits uint) Key {
+	for i := range k {
+		low := uint(len(k)-1-i) * 8
+		switch {
+		case low >= bits:
+			k[i] = 0
+		case low+8 > bits:
+			k[i] &= byte(1<<(bits-low)) - 1
+		}
+	}
+
+	return k
+}
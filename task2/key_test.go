@@ -0,0 +1,49 @@
+package main
+
+import (
+	"math/big"
+	"testing"
+)
+
+func TestHashKeyBits(t *testing.T) {
+	for _, bits := range []uint{1, 7, 8, 20, 64, 100, maxBits} {
+		k := HashKey("localhost:8080", bits)
+		if k.Int().BitLen() > int(bits) {
+			t.Errorf("key (%v) does not fit into %d bits", k, bits)
+		}
+	}
+
+	if HashKey("a", maxBits) != HashKey("a", maxBits).mask(maxBits) {
+		t.Errorf("a 160 bit key should keep the whole digest")
+	}
+
+	// The IDs of the uint64 ring: the first 8 bytes of the digest modulo
+	// 2^20.
+	if k := HashKey("localhost:8080", 20); k.String() != "597818" {
+		t.Errorf("Expected (597818), found (%v)", k)
+	}
+}
+
+func TestKeyFingerStartWraps(t *testing.T) {
+	k := KeyFromInt(big.NewInt(1048575), 20)
+
+	if got := k.fingerStart(0, 20); got != (Key{}) {
+		t.Errorf("expected the identifier to wrap to 0, found (%v)", got)
+	}
+
+	if got := k.fingerStart(19, 20).String(); got != "524287" {
+		t.Errorf("expected (524287), found (%v)", got)
+	}
+}
+
+func TestParseKey(t *testing.T) {
+	if k, err := ParseKey("1048575", 20); err != nil || k.String() != "1048575" {
+		t.Errorf("ParseKey(1048575) = (%v, %v)", k, err)
+	}
+
+	for _, s := range []string{"1048576", "-1", "abc"} {
+		if _, err := ParseKey(s, 20); err == nil {
+			t.Errorf("ParseKey(%v) should fail on a 20 bit ring", s)
+		}
+	}
+}
@@ -1,37 +1,171 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
 	"net"
+	"net/http"
 	"net/rpc"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
 )
 
 func main() {
+	os.Exit(dispatch("peer", []subcommand{
+		{"start", "[flags] [-join ADDR] [-admin ADDR]", func(args []string) int { return start(args, false) }},
+		{"repl", "[flags]", func(args []string) int { return start(args, true) }},
+		{"status", "[-address ADDR] [-json]", status},
+	}, os.Args[1:]))
+}
+
+// start runs a peer until it is interrupted, or until the interactive menu
+// exits when interactive is set.
+func start(args []string, interactive bool) int {
 	addr := ""
-	flag.StringVar(&addr, "address", "localhost:1234", "supply listening ip and port")
-	flag.Parse()
+	joinaddr := ""
+	adminaddr := ""
+	storeKind := ""
+	var interval time.Duration
+	var cfg Config
+	fs := flag.NewFlagSet("start", flag.ContinueOnError)
+	fs.StringVar(&addr, "address", "localhost:1234", "supply listening ip and port")
+	fs.StringVar(&joinaddr, "join", "", "address of a ring member to join through")
+	fs.StringVar(&adminaddr, "admin", "", "address to serve the HTTP/JSON admin endpoint on, disabled if empty")
+	fs.DurationVar(&interval, "stabilize", time.Second, "interval between periodic stabilization rounds")
+	fs.IntVar(&cfg.SuccListLen, "succs", defaultSuccListLen, "number of successors each node keeps for crash tolerance")
+	fs.IntVar(&cfg.Replicas, "replicas", defaultReplicas, "replication factor: number of nodes storing each file")
+	fs.DurationVar(&cfg.CallTimeout, "timeout", defaultCallTimeout, "deadline for every RPC issued by the node")
+	fs.StringVar(&cfg.LookupMode, "lookup", LookupRecursive, "lookup mode used by this node: recursive or iterative")
+	fs.UintVar(&cfg.Bits, "bits", defaultBits, "width m of the identifier space, up to 160")
+	fs.StringVar(&storeKind, "store", StoreFS, "storage backend for files: fs, mem or cas (content-addressed)")
+	fs.StringVar(&cfg.DataDir, "data-dir", ".", "directory under which the node keeps its files and state")
+	fs.Int64Var(&cfg.MaxBytes, "max-bytes", 0, "maximum number of bytes the node stores, 0 for no limit")
+	fs.IntVar(&cfg.MaxFiles, "max-files", 0, "maximum number of files the node stores, 0 for no limit")
+	fs.IntVar(&cfg.FailAfter, "fail-after", defaultFailAfter, "missed heartbeats after which a neighbour is declared dead")
+	if rest, err := parseArgs(fs, args); err != nil || len(rest) != 0 {
+		fs.Usage()
+		return exitUsage
+	}
+
+	if cfg.Bits == 0 || cfg.Bits > maxBits {
+		log.Printf("identifier space must be between 1 and %d bits", maxBits)
+		return exitUsage
+	}
+
+	if cfg.LookupMode != LookupRecursive && cfg.LookupMode != LookupIterative {
+		log.Printf("unknown lookup mode (%v)", cfg.LookupMode)
+		return exitUsage
+	}
 
 	ln, err := net.Listen("tcp4", addr)
 	if err != nil {
-		log.Fatal(err)
+		log.Println(err)
+		return exitErr
+	}
+
+	caller := NewRPCCaller()
+	cfg.Caller = caller
+
+	cfg.Store, err = NewStore(storeKind, filepath.Join(cfg.DataDir, HashKey(ln.Addr().String(), cfg.Bits).String()))
+	if err != nil {
+		log.Println(err)
+		return exitUsage
 	}
 
-	node := NewNode(ln.Addr().String())
+	node := NewNode(ln.Addr().String(), cfg)
 	rpc.Register(node)
 
-	go func() {
-		for {
-			conn, err := ln.Accept()
-			if err != nil {
-				log.Println(err)
-				continue
-			}
-			rpc.ServeConn(conn)
+	go node.serve(ln)
+
+	if adminaddr != "" {
+		go func() {
+			log.Println("admin endpoint:", http.ListenAndServe(adminaddr, node.AdminHandler()))
+		}()
+	}
+
+	go node.maintain(interval, caller)
+
+	ctx := context.Background()
+
+	if joinaddr != "" {
+		if err := node.join(ctx, joinaddr, caller); err != nil {
+			log.Println(err)
+			return exitErr
 		}
-	}()
+	} else if err := node.rejoin(ctx, caller); err != nil {
+		// A node restarted from an existing directory rejoins the ring
+		// through the neighbours it knew before going down.
+		log.Println("rejoining the ring:", err)
+	}
+
+	if interactive {
+		repl(ctx, node, caller)
+		return exitOK
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	<-sig
 
+	if err := node.leave(ctx, caller); err != nil {
+		// Our files stay on disk, a restart picks them up again.
+		log.Println(err)
+		node.shutdown()
+		return exitErr
+	}
+
+	return exitOK
+}
+
+// status prints the state of a running peer.
+func status(args []string) int {
+	addr := ""
+	asJSON := false
+	var timeout time.Duration
+	fs := flag.NewFlagSet("status", flag.ContinueOnError)
+	fs.StringVar(&addr, "address", "localhost:1234", "address of the peer to query")
+	fs.BoolVar(&asJSON, "json", false, "print the status as JSON")
+	fs.DurationVar(&timeout, "timeout", defaultCallTimeout, "deadline for the status RPC")
+	if rest, err := parseArgs(fs, args); err != nil || len(rest) != 0 {
+		fs.Usage()
+		return exitUsage
+	}
+
+	caller := NewRPCCaller()
+	defer caller.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var ns NodeStatus
+	if err := caller.CallContext(ctx, addr, "Status", "", &ns); err != nil {
+		log.Println(err)
+		return exitErr
+	}
+
+	if !asJSON {
+		printStatus(os.Stdout, ns)
+		return exitOK
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(ns); err != nil {
+		log.Println(err)
+		return exitErr
+	}
+
+	return exitOK
+}
+
+// repl runs the interactive menu.
+func repl(ctx context.Context, node *Node, caller Caller) {
 	choice := 0
 	for {
 		fmt.Println("=====================================")
@@ -51,28 +185,42 @@ func main() {
 			joinaddr := ""
 			fmt.Print("Enter Introducer Addr: ")
 			fmt.Scanf("%s", &joinaddr)
-			node.join(joinaddr, NewRPCCaller())
+			if err := node.join(ctx, joinaddr, caller); err != nil {
+				log.Println(err)
+			}
 		case 2:
-			var key uint64
+			var input string
 			fmt.Print("Enter Key: ")
-			fmt.Scanf("%d", &key)
-			lr := node.lookup(key, NewRPCCaller())
+			fmt.Scanf("%s", &input)
+			key, err := ParseKey(input, node.bits)
+			if err != nil {
+				fmt.Println(err)
+				break
+			}
+			lr := node.find(ctx, key, caller)
 			fmt.Printf("Found: %v (%v)\n", lr.Addr, lr.ID)
+			for i, hop := range lr.Hops {
+				fmt.Printf("  hop %d: %v (%v) in %v\n", i+1, hop.Addr, hop.ID, hop.Latency)
+			}
 		case 3:
 			var filename string
 			fmt.Print("Enter Filename: ")
-			fmt.Scanf("%d", &filename)
-			fmt.Printf("ID: %v\n", ID(filename))
+			fmt.Scanf("%s", &filename)
+			fmt.Printf("ID: %v\n", node.hash(filename))
 		case 4:
 			fmt.Printf("ID (%v)\n", node.id())
-			fmt.Printf("Predecessor ID (%v)\n", ID(node.Predecessor))
-			fmt.Printf("Successor ID: (%v)\n", ID(node.Successor))
+			fmt.Printf("Predecessor ID (%v)\n", node.hash(node.getPred()))
+			fmt.Printf("Successor ID: (%v)\n", node.hash(node.getSucc()))
 		case 5:
 			node.printFileTable()
 		case 6:
 			node.printFingerTable()
 		case 7:
-			node.leave(NewRPCCaller())
+			if err := node.leave(ctx, caller); err != nil {
+				log.Println(err)
+				break
+			}
+			return
 		}
 	}
 }
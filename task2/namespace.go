@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// ownerPrefix marks the first element of a stored name as the namespace of
+// the file's owner: alice's report.pdf is stored and hashed as
+// @alice/report.pdf, so it neither collides with bob's nor with the
+// report.pdf of the shared namespace, which has no owner.
+//
+// Owners are not authenticated. As with the user names of task1, whoever
+// names an owner gets to use its namespace: namespaces keep users from
+// clobbering each other's files by accident, not from reading or deleting
+// them on purpose.
+const ownerPrefix = "@"
+
+// fileName returns the name a file of owner is stored and hashed under.
+func fileName(owner, filename string) string {
+	if owner == "" {
+		return filename
+	}
+
+	return ownerPrefix + owner + "/" + filename
+}
+
+// splitFileName returns the owner and the file name of a stored name, see
+// fileName.
+func splitFileName(name string) (owner, filename string) {
+	if !strings.HasPrefix(name, ownerPrefix) {
+		return "", name
+	}
+
+	owner, filename, _ = strings.Cut(strings.TrimPrefix(name, ownerPrefix), "/")
+	return owner, filename
+}
+
+// checkName rejects owners and file names that would reach into another
+// namespace. File names must be clean relative paths: the store cleans them,
+// so ./a and a would hash to different keys but share a file on disk.
+func checkName(owner, filename string) error {
+	switch {
+	case strings.ContainsAny(owner, `/\`) || strings.HasPrefix(owner, "."):
+		return fmt.Errorf("invalid owner (%v)", owner)
+	case filename == "":
+		return fmt.Errorf("empty file name")
+	case owner == "" && strings.HasPrefix(filename, ownerPrefix):
+		return fmt.Errorf("file name (%v) is reserved, names starting with (%v) belong to owners", filename, ownerPrefix)
+	case strings.HasPrefix(filename, "/") || filename != path.Clean(filename):
+		return fmt.Errorf("invalid file name (%v), expected a clean relative path", filename)
+	}
+
+	for _, elem := range strings.Split(filename, "/") {
+		if elem == "" || elem == "." || elem == ".." {
+			return fmt.Errorf("invalid file name (%v)", filename)
+		}
+	}
+
+	return nil
+}
+
+// resolveName checks the owner and file name of a request for the file of
+// key id and returns the name the file is stored under.
+func (n *Node) resolveName(owner, filename string, id Key) (string, error) {
+	if err := checkName(owner, filename); err != nil {
+		return "", err
+	}
+
+	name := fileName(owner, filename)
+	if id != n.hash(name) {
+		return "", fmt.Errorf("key (%v) does not belong to file (%v) of owner (%v)", id, filename, owner)
+	}
+
+	return name, nil
+}
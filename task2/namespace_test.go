@@ -0,0 +1,57 @@
+package main
+
+import "testing"
+
+func TestFileName(t *testing.T) {
+	tests := []struct {
+		owner, filename, name string
+	}{
+		{"", "report.pdf", "report.pdf"},
+		{"alice", "report.pdf", "@alice/report.pdf"},
+		{"alice", "docs/report.pdf", "@alice/docs/report.pdf"},
+	}
+
+	for _, test := range tests {
+		if name := fileName(test.owner, test.filename); name != test.name {
+			t.Errorf("Expected (%v), found (%v)", test.name, name)
+		}
+
+		owner, filename := splitFileName(test.name)
+		if owner != test.owner || filename != test.filename {
+			t.Errorf("Expected (%v, %v), found (%v, %v)", test.owner, test.filename, owner, filename)
+		}
+	}
+}
+
+func TestCheckName(t *testing.T) {
+	tests := []struct {
+		owner, filename string
+		ok              bool
+	}{
+		{"", "report.pdf", true},
+		{"alice", "report.pdf", true},
+		{"alice", "docs/report.pdf", true},
+		{"alice", "", false},
+		{"", "@alice/report.pdf", false},
+		{"alice", "@bob/report.pdf", true},
+		{"al/ice", "report.pdf", false},
+		{`al\ice`, "report.pdf", false},
+		{"..", "report.pdf", false},
+		{".alice", "report.pdf", false},
+		{"alice", "../bob/report.pdf", false},
+		{"alice", "docs/../../report.pdf", false},
+		{"alice", "./report.pdf", false},
+		{"alice", "docs//report.pdf", false},
+		{"alice", "docs/./report.pdf", false},
+		{"alice", "docs/", false},
+		{"alice", "/report.pdf", false},
+		{"", ".", false},
+		{"", "..", false},
+	}
+
+	for _, test := range tests {
+		if err := checkName(test.owner, test.filename); (err == nil) != test.ok {
+			t.Errorf("Expected (%v) for (%v, %v), found (%v)", test.ok, test.owner, test.filename, err)
+		}
+	}
+}
@@ -1,464 +1,1221 @@
 package main
 
 import (
-	"crypto/sha1"
-	"encoding/binary"
+	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
-	"math"
+	"net"
 	"net/rpc"
 	"os"
-	"path/filepath"
-	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
-type Caller interface {
-	Call(addr, proc string, args interface{}, reply interface{}) error
+// Config holds the tunable parameters of a Node. Zero values fall back to the
+// defaults.
+type Config struct {
+	// Bits is the width m of the identifier space; the ring holds 2^m
+	// identifiers. All nodes of a ring must agree on it.
+	Bits uint
+	// SuccListLen is the number of successors (r) each node keeps track of.
+	SuccListLen int
+	// Replicas is the replication factor (k): every file is stored on its
+	// responsible node and copied to the first k-1 successors.
+	Replicas int
+	// Caller is used for the RPCs the node issues while serving requests.
+	// Defaults to a pooled RPCCaller.
+	Caller Caller
+	// CallTimeout bounds every single RPC the node issues.
+	CallTimeout time.Duration
+	// LookupMode is either LookupRecursive or LookupIterative.
+	LookupMode string
+	// Store holds the content of the node's files. Defaults to an FSStore
+	// in the node's directory.
+	Store Store
+	// DataDir is where the node keeps its directory, named after its ID.
+	// Defaults to the working directory.
+	DataDir string
+	// MaxBytes and MaxFiles bound what the node stores, replicas included.
+	// Zero means unlimited.
+	MaxBytes int64
+	MaxFiles int
+	// FailAfter is how many round trips in a row a neighbour may miss
+	// before it is declared dead and purged.
+	FailAfter int
 }
 
+const (
+	defaultBits        = 20
+	defaultSuccListLen = 3
+	defaultReplicas    = 3
+	defaultCallTimeout = 5 * time.Second
+)
+
+const (
+	// LookupRecursive forwards the lookup from node to node.
+	LookupRecursive = "recursive"
+	// LookupIterative has the originating node query every hop itself.
+	LookupIterative = "iterative"
+)
+
+// maxHops bounds iterative lookups, which could otherwise loop forever on a
+// ring whose pointers are inconsistent.
+const maxHops = 64
+
+// A leaving node tries handOffAttempts times to hand each file over, waiting
+// a multiple of handOffBackoff in between.
+const (
+	handOffAttempts = 3
+	handOffBackoff  = 100 * time.Millisecond
+)
+
 type Node struct {
-	Addr        string
+	Addr string
+	// Successor and Predecessor are guarded by muroute, use getSucc and
+	// getPred to read them.
 	Successor   string
 	Predecessor string
 
-	mufile    sync.Mutex
-	fileTable map[uint64]string
-
-	mufing      sync.Mutex
+	bits        uint
+	muroute     sync.RWMutex
+	succList    []string
+	succListLen int
+
+	mufile       sync.Mutex
+	store        Store
+	dataDir      string
+	maxBytes     int64
+	maxFiles     int
+	usage        *usage
+	fileTable    map[Key]string
+	replicaTable map[Key]string
+	tombstones   map[Key]tombstone
+	replicas     int
+	replicatedTo []string
+	// lastKnown holds the neighbours saved by a previous run.
+	lastKnown []string
+	// handoffs tracks the ranges being shared with new predecessors, see
+	// handOffRange, and pending counts those queued or under way.
+	handoffs  sync.WaitGroup
+	pending   atomic.Int32
+	muhandoff sync.Mutex
+
+	// fingerTable is never modified in place, writers replace it as a
+	// whole so that readers can keep using the slice they got.
+	mufing      sync.RWMutex
 	fingerTable []string
+	next        int
+
+	caller      Caller
+	callTimeout time.Duration
+	lookupMode  string
+	stats       *rpcStats
+	detector    *detector
+	quit        chan struct{}
+	stopOnce    sync.Once
+
+	muconn   sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]bool
 }
 
-func NewNode(addr string) *Node {
-	return &Node{Addr: addr, Successor: addr, Predecessor: addr,
-		fingerTable: make([]string, 20, 20),
-		fileTable:   make(map[uint64]string)}
+func NewNode(addr string, cfg Config) *Node {
+	if cfg.Bits == 0 {
+		cfg.Bits = defaultBits
+	}
+	if cfg.Bits > maxBits {
+		cfg.Bits = maxBits
+	}
+	if cfg.SuccListLen <= 0 {
+		cfg.SuccListLen = defaultSuccListLen
+	}
+	if cfg.Replicas <= 0 {
+		cfg.Replicas = defaultReplicas
+	}
+	if cfg.SuccListLen < cfg.Replicas-1 {
+		cfg.SuccListLen = cfg.Replicas - 1
+	}
+	if cfg.Caller == nil {
+		cfg.Caller = NewRPCCaller()
+	}
+	if cfg.CallTimeout <= 0 {
+		cfg.CallTimeout = defaultCallTimeout
+	}
+	if cfg.LookupMode == "" {
+		cfg.LookupMode = LookupRecursive
+	}
+	if cfg.FailAfter <= 0 {
+		cfg.FailAfter = defaultFailAfter
+	}
+
+	n := &Node{Addr: addr, Successor: addr, Predecessor: addr,
+		bits:         cfg.Bits,
+		succList:     []string{addr},
+		succListLen:  cfg.SuccListLen,
+		fingerTable:  make([]string, cfg.Bits, cfg.Bits),
+		fileTable:    make(map[Key]string),
+		replicaTable: make(map[Key]string),
+		tombstones:   make(map[Key]tombstone),
+		replicas:     cfg.Replicas,
+		dataDir:      cfg.DataDir,
+		maxBytes:     cfg.MaxBytes,
+		maxFiles:     cfg.MaxFiles,
+		usage:        newUsage(),
+		caller:       cfg.Caller,
+		callTimeout:  cfg.CallTimeout,
+		lookupMode:   cfg.LookupMode,
+		stats:        newRPCStats(),
+		detector:     newDetector(cfg.FailAfter),
+		quit:         make(chan struct{}),
+		conns:        make(map[net.Conn]bool)}
+
+	n.store = cfg.Store
+	if n.store == nil {
+		n.store = NewFSStore(n.dir())
+	}
+
+	if err := n.loadState(); err != nil {
+		log.Println("loading node state:", err)
+	}
+
+	return n
 }
 
 type LookupResp struct {
 	Addr string
-	ID   uint64
+	ID   Key
+	// Hops lists the nodes queried by an iterative lookup, in order.
+	Hops []Hop
+}
+
+type Hop struct {
+	Addr    string
+	ID      Key
+	Latency time.Duration
+}
+
+type ClosestPrecedingResp struct {
+	Addr string
+	ID   Key
+	// Done is set when Addr is the successor of the key rather than the
+	// next hop.
+	Done bool
 }
 
 type UploadFileReq struct {
 	Content  []byte
 	Filename string
-	ID       uint64
+	// Owner is the namespace of the file, empty for the shared one. It is
+	// not authenticated. See ownerPrefix.
+	Owner   string
+	ID      Key
+	Replica bool
+	// Size is the length of the whole file for chunked uploads.
+	Size int64
+	// Checksum is the hex SHA-256 of the whole file.
+	Checksum string
+	// Stored is when the sending node stored its copy, set when nodes
+	// push files to each other. See tombstone.
+	Stored time.Time
 }
 
 type UploadFileResp struct {
-	Err error
+	// Offset is how much of a chunked upload the node has received.
+	Offset int64
+	// Checksum is the verified checksum of a committed upload.
+	Checksum string
 }
 
 type ShareFilesReq struct {
-	PredID uint64
-	ID     uint64
+	PredID Key
+	ID     Key
 	Addr   string
 }
 
-type ShareFilesResp struct {
-	Err error
-}
-
 type RetrieveFileReq struct {
 	Filename string
-	ID       uint64
+	// Owner is the namespace of the file, see UploadFileReq.
+	Owner string
+	ID    Key
+	// Offset and Length select the chunk to return. Length is capped at
+	// chunkSize.
+	Offset int64
+	Length int64
+	// Replica accepts the copy of a node that is not responsible for the
+	// file.
+	Replica bool
 }
 
 type RetrieveFileResp struct {
 	Content  []byte
 	Filename string
-	ID       uint64
-	Err      error
+	ID       Key
+	// Size is the length of the whole file.
+	Size int64
+	// Checksum is the hex SHA-256 stored with the file.
+	Checksum string
 }
 
 type GetPredResp struct {
 	Addr string
-	ID   uint64
+	ID   Key
 }
 
 type GetSuccResp struct {
 	Addr string
-	ID   uint64
+	ID   Key
 }
 
-type SetPredResp struct {
-	Addr string
-	ID   uint64
+type GetSuccListResp struct {
+	Addrs []string
+}
+
+// DepartReq announces that Addr leaves the ring. Pred and Succs are its
+// predecessor and successor list.
+type DepartReq struct {
+	Addr  string
+	Pred  string
+	Succs []string
 }
 
-type SetSuccResp struct {
+type RingResp struct {
+	Bits uint
+	// Addr is the address the answering node is known by in the ring.
 	Addr string
-	ID   uint64
 }
 
-func (n *Node) leave(client Caller) {
-	n.mufile.Lock()
-	defer n.mufile.Unlock()
+// leave hands our files over to the successor and takes us out of the ring,
+// then shuts the node down. Files are sent as replicas first, so that the
+// successor only takes them over once it adopts our predecessor; a leave
+// that fails before that point is aborted and leaves the node in the ring
+// with all its files.
+func (n *Node) leave(ctx context.Context, client Caller) error {
+	succ, pred := n.getSucc(), n.getPred()
+	if succ == n.Addr {
+		log.Print("last node of the ring, keeping files on disk")
+		n.shutdown()
+		return nil
+	}
 
-	var err error
+	files := n.files()
+	for fileid, filename := range files {
+		if err := n.handOff(ctx, client, fileid, filename); err != nil {
+			return fmt.Errorf("leave aborted: %w", err)
+		}
+	}
+	log.Printf("handed %d files over to successor", len(files))
+
+	// Once the successor adopted our predecessor it owns our keys. The
+	// predecessor following suit is not essential: should it fail, its
+	// stabilization falls back to the successor as soon as we are gone.
+	dr := DepartReq{Addr: n.Addr, Pred: pred, Succs: n.getSuccList()}
+	if err := n.call(ctx, client, n.getSucc(), "Depart", dr, new(string)); err != nil {
+		return fmt.Errorf("leave aborted: successor did not take over: %w", err)
+	}
+	if err := n.call(ctx, client, pred, "Depart", dr, new(string)); err != nil {
+		log.Printf("predecessor (%v) of ID (%v) did not take note of leave: %v", pred, n.hash(pred), err)
+	}
 
-	var ssr SetSuccResp
-	err = client.Call(n.Predecessor, "SetSucc", n.Successor, &ssr)
-	if err != nil {
-		log.Println(err)
+	for _, filename := range files {
+		if err := n.store.Delete(filename); err != nil {
+			log.Println(err)
+		}
 	}
 
-	var spr SetPredResp
-	err = client.Call(n.Successor, "SetPred", n.Predecessor, &spr)
-	if err != nil {
+	if err := os.RemoveAll(n.dir()); err != nil {
 		log.Println(err)
 	}
 
-	id := n.id()
-	for fileid, filename := range n.fileTable {
-		// go func(filename string, id uint64, client Caller) {
-		buff, err := ioutil.ReadFile(filepath.Join(strconv.FormatUint(id, 10), filename))
-		if err != nil {
-			log.Println(err)
-			continue
+	n.shutdown()
+	return nil
+}
+
+// handOff sends a file to the successor as a replica, retrying a few times
+// and following successor changes between attempts.
+func (n *Node) handOff(ctx context.Context, client Caller, fileid Key, filename string) error {
+	var err error
+	for attempt := 1; attempt <= handOffAttempts; attempt++ {
+		succ := n.getSucc()
+		if succ == n.Addr {
+			return fmt.Errorf("handing (%v) over: no successor left: %w", filename, err)
 		}
 
-		client.Call(n.Successor, "UploadFile", UploadFileReq{
-			Filename: filename,
-			Content:  buff,
-			ID:       fileid,
-		}, &UploadFileResp{})
+		if err = n.sendFile(ctx, client, succ, fileid, filename, true); err == nil {
+			return nil
+		}
 
-		if err := os.Remove(filepath.Join(strconv.FormatUint(n.id(), 10), filename)); err != nil {
-			log.Println(err)
-			return
+		log.Printf("handing (%v) over to (%v), attempt %d: %v", filename, succ, attempt, err)
+		if isDialErr(err) {
+			n.succFailed(succ)
 		}
 
-		delete(n.fileTable, fileid)
-		// }(filename, n.id(), client)
+		select {
+		case <-time.After(time.Duration(attempt) * handOffBackoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 	}
 
-	if err := os.RemoveAll(strconv.FormatUint(n.id(), 10)); err != nil {
-		log.Println(err)
-		return
+	return fmt.Errorf("handing (%v) over: %w", filename, err)
+}
+
+// depart updates our pointers for a neighbour leaving the ring, unless they
+// no longer point at it. The successor of the leaving node promotes the
+// replicas the leaving node handed over.
+func (n *Node) depart(dr DepartReq) {
+	n.muroute.Lock()
+	adopted := n.Predecessor == dr.Addr
+	if adopted {
+		n.Predecessor = dr.Pred
+		// A node that never learned its predecessor leaves ours unknown.
+		if dr.Pred == dr.Addr {
+			n.Predecessor = n.Addr
+		}
 	}
+	if n.Successor == dr.Addr {
+		var succs []string
+		for _, s := range dr.Succs {
+			if s != dr.Addr {
+				succs = append(succs, s)
+			}
+		}
+		if len(succs) == 0 {
+			succs = []string{n.Addr}
+		}
+		n.succList = n.succListFrom(succs[0], succs[1:])
+		n.Successor = n.succList[0]
+	}
+	n.muroute.Unlock()
 
-	var empty string
-	client.Call(n.Predecessor, "Stabilize", n.Predecessor, &empty)
-	log.Print("sending stabalize call")
+	if adopted {
+		log.Printf("(%v) of ID (%v) left, adopting (%v) of ID (%v) as predecessor", dr.Addr, n.hash(dr.Addr), n.getPred(), n.hash(n.getPred()))
+		n.promoteReplicas(n.hash(n.getPred()))
+		if err := n.saveState(); err != nil {
+			log.Println("saving node state:", err)
+		}
+	}
 }
 
-func (n *Node) join(peeraddr string, client Caller) {
+// join enters the ring that peeraddr belongs to. Only our own pointers are
+// set here: the successor learns about us through Notify, which it accepts
+// only if we are closer than its current predecessor, and our predecessor
+// finds us through its next stabilization. Nodes joining concurrently thus
+// never overwrite each other's pointers.
+func (n *Node) join(ctx context.Context, peeraddr string, client Caller) error {
 
 	log.Printf("joining through peer (%v)", peeraddr)
 
-	var lr LookupResp
-	var err error
+	var rr RingResp
+	if err := n.call(ctx, client, peeraddr, "Ring", "", &rr); err != nil {
+		return err
+	}
 
-	err = client.Call(peeraddr, "Lookup", n.id(), &lr)
-	if err != nil {
-		log.Println(err)
+	if rr.Bits != n.bits {
+		return fmt.Errorf("ring of peer (%v) uses %d bit identifiers, this node uses %d", peeraddr, rr.Bits, n.bits)
 	}
 
+	var lr LookupResp
+	if err := n.call(ctx, client, peeraddr, "Lookup", n.id(), &lr); err != nil {
+		return err
+	}
+	if lr.Addr == "" {
+		return fmt.Errorf("peer (%v) found no successor for ID (%v)", peeraddr, n.id())
+	}
+
+	// Our predecessor is unknown until it notifies us.
+	n.setPred(n.Addr)
 	n.setSucc(lr.Addr)
-	log.Printf("setting successor to (%v) of ID (%v)", lr.Addr, ID(lr.Addr))
+	log.Printf("setting successor to (%v) of ID (%v)", lr.Addr, n.hash(lr.Addr))
 
-	var gpr GetPredResp
-	err = client.Call(n.Successor, "GetPred", "", &gpr)
-	if err != nil {
-		log.Println("GetPred", err)
+	var gslr GetSuccListResp
+	if err := n.call(ctx, client, lr.Addr, "GetSuccList", "", &gslr); err != nil {
+		log.Println("GetSuccList", err)
+	} else {
+		n.updateSuccList(lr.Addr, gslr.Addrs)
 	}
 
-	n.setPred(gpr.Addr)
-	log.Printf("setting predecessor to (%v) of ID (%v)", gpr.Addr, ID(gpr.Addr))
-
-	var spr SetPredResp
-	err = client.Call(n.Successor, "SetPred", n.Addr, &spr)
-	if err != nil {
-		log.Println(err)
+	// The successor adopts us as its predecessor and then hands over the
+	// files we are now responsible for in the background, so they may
+	// arrive after the join returns.
+	var empty string
+	if err := n.call(ctx, client, lr.Addr, "Notify", n.Addr, &empty); err != nil {
+		log.Println("Notify", err)
 	}
 
-	log.Printf("setting self (%v) of ID (%v) as predecessor of successor (%v) of ID (%v)", n.Addr, ID(n.Addr), n.Successor, ID(n.Successor))
+	n.calcFingerTable(ctx, client)
+	log.Print("calculated self's finger table")
 
-	var ssr SetSuccResp
-	err = client.Call(n.Predecessor, "SetSucc", n.Addr, &ssr)
-	if err != nil {
-		log.Println(err)
+	return nil
+}
+
+func (n *Node) calcFingerTable(ctx context.Context, caller Caller) {
+	table := make([]string, n.bits)
+	for i := range table {
+		lr := n.lookupbasic(ctx, n.id().fingerStart(uint(i), n.bits), caller)
+		table[i] = lr.Addr
 	}
 
-	log.Printf("setting self (%v) of ID (%v) as successor of predecessor (%v) of ID (%v)", n.Addr, ID(n.Addr), n.Predecessor, ID(n.Predecessor))
+	n.mufing.Lock()
+	n.fingerTable = table
+	n.mufing.Unlock()
+}
 
-	n.calcFingerTable()
+// fingers returns the current finger table. It must not be modified.
+func (n *Node) fingers() []string {
+	n.mufing.RLock()
+	defer n.mufing.RUnlock()
 
-	log.Print("calculated self's finger table")
+	return n.fingerTable
+}
 
-	var empty string
-	err = client.Call(n.Predecessor, "CalcFingerTable", empty, &empty)
-	if err != nil {
-		log.Println(err)
-	}
-	log.Print("calculated predecessor's finger table")
+// setFinger replaces the finger table with a copy that has entry i set to
+// addr.
+func (n *Node) setFinger(i int, addr string) {
+	n.mufing.Lock()
+	defer n.mufing.Unlock()
 
-	err = client.Call(n.Successor, "CalcFingerTable", empty, &empty)
-	if err != nil {
-		log.Println(err)
-	}
-	log.Print("calculated successor's finger table")
+	table := append([]string(nil), n.fingerTable...)
+	table[i] = addr
+	n.fingerTable = table
+}
 
-	err = client.Call(n.Successor, "ShareFiles", ShareFilesReq{PredID: ID(n.Predecessor), ID: n.id(), Addr: n.Addr}, &ShareFilesResp{})
-	if err != nil {
-		log.Println(err)
+func (n *Node) id() Key {
+	return n.hash(n.Addr)
+}
+
+// hash maps an address or filename onto the node's ring.
+func (n *Node) hash(s string) Key {
+	return HashKey(s, n.bits)
+}
+
+func (n *Node) lookup(ctx context.Context, id Key, caller Caller) LookupResp {
+	succ := n.getSucc()
+	if betweenRight(id, n.id(), n.hash(succ)) {
+		return LookupResp{Addr: succ, ID: n.hash(succ)}
 	}
 
-	client.Call(n.Predecessor, "Stabilize", n.Addr, &empty)
-	if err != nil {
-		log.Println(err)
+	p := n.closestPrecedingNode(id)
+	if p == n.Addr {
+		return LookupResp{Addr: succ, ID: n.hash(succ)}
 	}
-	log.Print("sending stabalize call")
 
-	// Somehow Get Related Files from successor
+	return n.forwardLookup(ctx, p, id, caller)
 }
 
-func (n *Node) calcFingerTable() {
-	for i := 0; i < len(n.fingerTable); i++ {
-		lr := n.lookupbasic((n.id()+uint64(math.Pow(2, float64(i))))%1048576, NewRPCCaller())
-		n.fingerTable[i] = lr.Addr
+// closestPrecedingNode returns the known node (finger or successor list entry)
+// that most closely precedes id on the circle, or ourselves if there is none.
+func (n *Node) closestPrecedingNode(id Key) string {
+	best := n.Addr
+	candidates := append(n.getSuccList(), n.fingers()...)
+	for _, c := range candidates {
+		if c == "" || !between(n.hash(c), n.id(), id) {
+			continue
+		}
+
+		if best == n.Addr || between(n.hash(c), n.hash(best), id) {
+			best = c
+		}
 	}
-}
 
-func (n *Node) id() uint64 {
-	hashBytes := sha1.Sum([]byte(n.Addr))
-	return binary.BigEndian.Uint64(hashBytes[:]) % 1048576
+	return best
 }
 
-func ID(addr string) uint64 {
-	hashBytes := sha1.Sum([]byte(addr))
-	return binary.BigEndian.Uint64(hashBytes[:]) % 1048576
+// forwardLookup asks p to resolve id, falling back to walking the successor
+// list when p cannot be reached.
+func (n *Node) forwardLookup(ctx context.Context, p string, id Key, caller Caller) LookupResp {
+	var lr LookupResp
+	err := n.call(ctx, caller, p, "Lookup", id, &lr)
+	if isDialErr(err) {
+		if p == n.getSucc() {
+			n.succFailed(p)
+		}
+		return n.lookupbasic(ctx, id, caller)
+	}
+	if err != nil {
+		log.Println("Lookup", err)
+	}
+
+	return lr
 }
 
-func (n *Node) lookup(id uint64, caller Caller) LookupResp {
+func (n *Node) lookupbasic(ctx context.Context, id Key, caller Caller) LookupResp {
+	for {
+		succ := n.getSucc()
+		if betweenRight(id, n.id(), n.hash(succ)) {
+			return LookupResp{Addr: succ, ID: n.hash(succ)}
+		}
 
-	if n.id() == ID(n.Successor) {
-		return LookupResp{Addr: n.Successor, ID: ID(n.Successor)}
-	}
+		var lr LookupResp
+		err := n.call(ctx, caller, succ, "Lookup", id, &lr)
+		if isDialErr(err) {
+			n.succFailed(succ)
+			continue
+		}
+		if err != nil {
+			log.Println("Lookup", err)
+		}
 
-	p := n.Addr
-	ft := n.fingerTable[0]
+		return lr
+	}
+}
 
-	switch {
-	case ID(p) < id && id <= ID(ft):
-		return LookupResp{Addr: ft, ID: ID(ft)}
-	case ID(p) > ID(ft) && ID(p) < id:
-		return LookupResp{Addr: ft, ID: ID(ft)}
-	case ID(p) > ID(ft) && id <= ID(ft):
-		return LookupResp{Addr: ft, ID: ID(ft)}
+// find resolves the successor of id using the node's configured lookup mode.
+func (n *Node) find(ctx context.Context, id Key, caller Caller) LookupResp {
+	if n.lookupMode == LookupIterative {
+		return n.lookupIterative(ctx, id, caller)
 	}
 
-	p = ft
+	return n.lookup(ctx, id, caller)
+}
 
-	for i := 1; i < len(n.fingerTable); i++ {
-		ft = n.fingerTable[i]
-		switch {
-		case ID(p) < id && id <= ID(ft):
-			var lr LookupResp
-			caller.Call(p, "Lookup", id, &lr)
-			return lr
-		case ID(p) > ID(ft) && ID(p) < id:
-			var lr LookupResp
-			caller.Call(p, "Lookup", id, &lr)
-			return lr
-		case ID(p) > ID(ft) && id <= ID(ft):
-			var lr LookupResp
-			caller.Call(p, "Lookup", id, &lr)
+// lookupIterative resolves id by asking each hop for its closest preceding
+// node itself, instead of having the hops forward the request. The returned
+// LookupResp lists every queried hop with its round-trip latency.
+func (n *Node) lookupIterative(ctx context.Context, id Key, caller Caller) LookupResp {
+	var hops []Hop
+
+	cpr := n.closestPreceding(id)
+	for !cpr.Done {
+		if len(hops) == maxHops {
+			log.Printf("iterative lookup of (%v) exceeded %d hops", id, maxHops)
+			return LookupResp{Hops: hops}
+		}
+
+		var next ClosestPrecedingResp
+		start := time.Now()
+		err := n.call(ctx, caller, cpr.Addr, "ClosestPreceding", id, &next)
+		hops = append(hops, Hop{Addr: cpr.Addr, ID: cpr.ID, Latency: time.Since(start)})
+		if err != nil {
+			log.Println("ClosestPreceding", err)
+			if isDialErr(err) && cpr.Addr == n.getSucc() {
+				n.succFailed(cpr.Addr)
+			}
+
+			lr := n.lookupbasic(ctx, id, caller)
+			lr.Hops = hops
 			return lr
 		}
 
-		p = ft
+		cpr = next
 	}
 
-	var lr LookupResp
-	caller.Call(p, "Lookup", id, &lr)
-	return lr
+	return LookupResp{Addr: cpr.Addr, ID: cpr.ID, Hops: hops}
 }
 
-func (n *Node) lookupbasic(id uint64, caller Caller) LookupResp {
-	switch {
-	case n.id() == ID(n.Successor):
-		return LookupResp{Addr: n.Successor, ID: ID(n.Successor)}
-	case n.id() < id && id <= ID(n.Successor):
-		return LookupResp{Addr: n.Successor, ID: ID(n.Successor)}
-	case n.id() > ID(n.Successor) && n.id() < id:
-		return LookupResp{Addr: n.Successor, ID: ID(n.Successor)}
-	case n.id() > ID(n.Successor) && id <= ID(n.Successor):
-		return LookupResp{Addr: n.Successor, ID: ID(n.Successor)}
-	default:
-		var lr LookupResp
-		caller.Call(n.Successor, "Lookup", id, &lr)
-		return lr
+// closestPreceding answers one step of an iterative lookup: either our
+// successor is responsible for id, or the caller should continue at our
+// closest preceding node.
+func (n *Node) closestPreceding(id Key) ClosestPrecedingResp {
+	succ := n.getSucc()
+	if betweenRight(id, n.id(), n.hash(succ)) {
+		return ClosestPrecedingResp{Addr: succ, ID: n.hash(succ), Done: true}
+	}
+
+	p := n.closestPrecedingNode(id)
+	if p == n.Addr {
+		return ClosestPrecedingResp{Addr: succ, ID: n.hash(succ), Done: true}
 	}
+
+	return ClosestPrecedingResp{Addr: p, ID: n.hash(p)}
+}
+
+// call issues an RPC through caller, bounded by the node's per-call timeout.
+func (n *Node) call(ctx context.Context, caller Caller, addr, proc string, args interface{}, reply interface{}) error {
+	ctx, cancel := context.WithTimeout(ctx, n.callTimeout)
+	defer cancel()
+
+	start := time.Now()
+	err := caller.CallContext(ctx, addr, proc, args, reply)
+	n.stats.record(RPCCall{Proc: proc, Addr: addr, Start: start, Latency: time.Since(start)}, err)
+	n.observe(addr, err)
+
+	return err
 }
 
 func (n *Node) setPred(predecessor string) {
+	n.muroute.Lock()
+	defer n.muroute.Unlock()
+
 	n.Predecessor = predecessor
 }
 
+// setSucc makes successor the first entry of the successor list, keeping the
+// remaining entries as fallbacks until the next stabilization round.
 func (n *Node) setSucc(successor string) {
+	n.muroute.Lock()
+	defer n.muroute.Unlock()
+
+	list := []string{successor}
+	for _, s := range n.succList {
+		if len(list) == n.succListLen {
+			break
+		}
+		if s != successor && s != n.Addr {
+			list = append(list, s)
+		}
+	}
+
+	n.succList = list
 	n.Successor = successor
 }
 
+// updateSuccList rebuilds the successor list from succ and the successor list
+// reported by succ, stopping once the list wraps around to ourselves.
+func (n *Node) updateSuccList(succ string, succs []string) {
+	list := n.succListFrom(succ, succs)
+
+	n.muroute.Lock()
+	defer n.muroute.Unlock()
+
+	n.succList = list
+	n.Successor = succ
+}
+
+// succListFrom builds a successor list from succ and the successor list
+// reported by succ.
+func (n *Node) succListFrom(succ string, succs []string) []string {
+	list := []string{succ}
+	for _, s := range succs {
+		if len(list) == n.succListLen || s == n.Addr {
+			break
+		}
+		if s != succ {
+			list = append(list, s)
+		}
+	}
+
+	return list
+}
+
+// succFailed drops a successor that can no longer be dialed and falls back to
+// the next live entry of the successor list.
+func (n *Node) succFailed(addr string) {
+	n.muroute.Lock()
+	defer n.muroute.Unlock()
+
+	var list []string
+	for _, s := range n.succList {
+		if s != addr {
+			list = append(list, s)
+		}
+	}
+
+	if len(list) == 0 {
+		list = []string{n.Addr}
+	}
+
+	n.succList = list
+	n.Successor = list[0]
+	log.Printf("successor (%v) of ID (%v) failed, falling back to (%v) of ID (%v)", addr, n.hash(addr), list[0], n.hash(list[0]))
+}
+
+func (n *Node) getSuccList() []string {
+	n.muroute.RLock()
+	defer n.muroute.RUnlock()
+
+	return append([]string(nil), n.succList...)
+}
+
 func (n *Node) getPred() string {
+	n.muroute.RLock()
+	defer n.muroute.RUnlock()
+
 	return n.Predecessor
 }
 
 func (n *Node) getSucc() string {
+	n.muroute.RLock()
+	defer n.muroute.RUnlock()
+
 	return n.Successor
 }
 
-func (n *Node) stabilize(origin string, caller Caller) error {
-	n.calcFingerTable()
-	log.Print("Stabalized: DONE")
-	if n.Predecessor == origin {
-		return nil
+// maintain runs the periodic Chord maintenance tasks (heartbeats,
+// check_predecessor, stabilize/notify, fix_fingers, the handoff of stray
+// files and the expiry of abandoned uploads and old tombstones) every
+// interval until the node shuts down. A replica target that dies is replaced right away instead of
+// on the next tick.
+func (n *Node) maintain(interval time.Duration, caller Caller) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	events, cancel := n.detector.subscribe()
+	defer cancel()
+
+	ctx := context.Background()
+
+	for {
+		select {
+		case <-n.quit:
+			return
+		case ev := <-events:
+			if ev.State == PeerDead && n.replicatesTo(ev.Addr) {
+				n.checkReplicas(ctx, caller)
+			}
+		case <-ticker.C:
+			n.heartbeat(ctx, caller)
+			n.checkPred(ctx, caller)
+			n.stabilizeSucc(ctx, caller)
+			n.fixFingers(ctx, caller)
+			n.checkReplicas(ctx, caller)
+			n.handOffStray()
+			n.expireUploads()
+			n.expireTombstones()
+			if err := n.saveState(); err != nil {
+				log.Println("saving node state:", err)
+			}
+		}
 	}
+}
+
+// serve accepts RPC connections on ln until the node shuts down.
+func (n *Node) serve(ln net.Listener) {
+	n.muconn.Lock()
+	n.listener = ln
+	n.muconn.Unlock()
 
-	go func(origin string, caller Caller) {
-		var empty string
-		if err := caller.Call(n.Predecessor, "Stabilize", origin, &empty); err != nil {
-			log.Println("Error in stabilize: ", err)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			select {
+			case <-n.quit:
+				return
+			default:
+			}
+
+			log.Println(err)
+			continue
 		}
-	}(origin, caller)
 
-	return nil
+		n.muconn.Lock()
+		n.conns[conn] = true
+		n.muconn.Unlock()
+
+		go func() {
+			rpc.ServeConn(conn)
+
+			n.muconn.Lock()
+			delete(n.conns, conn)
+			n.muconn.Unlock()
+		}()
+	}
+}
+
+// shutdown stops the maintenance loop, the listener and every open
+// connection. It is safe to call more than once.
+func (n *Node) shutdown() {
+	n.stopOnce.Do(func() {
+		close(n.quit)
+
+		n.muconn.Lock()
+		defer n.muconn.Unlock()
+
+		if n.listener != nil {
+			n.listener.Close()
+		}
+		for conn := range n.conns {
+			conn.Close()
+		}
+	})
+}
+
+// done is closed once the node shuts down.
+func (n *Node) done() <-chan struct{} {
+	return n.quit
+}
+
+// stabilizeSucc asks the successor for its predecessor, adopts it as the new
+// successor if it sits between us and the successor, and then notifies the
+// successor about us.
+func (n *Node) stabilizeSucc(ctx context.Context, caller Caller) {
+	succ := n.getSucc()
+
+	var gpr GetPredResp
+	for succ != n.Addr {
+		err := n.call(ctx, caller, succ, "GetPred", "", &gpr)
+		if err == nil {
+			break
+		}
+		if !isDialErr(err) {
+			log.Println("GetPred", err)
+			return
+		}
+
+		n.succFailed(succ)
+		succ = n.getSucc()
+	}
+
+	if succ == n.Addr {
+		gpr.Addr = n.getPred()
+	}
+
+	if gpr.Addr != "" && between(n.hash(gpr.Addr), n.id(), n.hash(succ)) {
+		log.Printf("adopting (%v) of ID (%v) as successor", gpr.Addr, n.hash(gpr.Addr))
+		n.setSucc(gpr.Addr)
+		succ = gpr.Addr
+	}
+
+	if succ == n.Addr {
+		return
+	}
+
+	var gslr GetSuccListResp
+	if err := n.call(ctx, caller, succ, "GetSuccList", "", &gslr); err != nil {
+		log.Println("GetSuccList", err)
+	} else {
+		n.updateSuccList(succ, gslr.Addrs)
+	}
+
+	var empty string
+	if err := n.call(ctx, caller, succ, "Notify", n.Addr, &empty); err != nil {
+		log.Println("Notify", err)
+	}
+}
+
+// notify adopts candidate as predecessor if it is closer than the current one
+// and hands it the files that now fall into its range.
+func (n *Node) notify(candidate string) {
+	// Check and update under one lock, so that of two concurrent
+	// candidates the closer one wins.
+	n.muroute.Lock()
+	pred := n.Predecessor
+	adopt := between(n.hash(candidate), n.hash(pred), n.id())
+	if adopt {
+		n.Predecessor = candidate
+	}
+	n.muroute.Unlock()
+
+	if !adopt {
+		return
+	}
+
+	log.Printf("adopting (%v) of ID (%v) as predecessor", candidate, n.hash(candidate))
+	n.promoteReplicas(n.hash(candidate))
+
+	n.handOffRange(ShareFilesReq{PredID: n.hash(pred), ID: n.hash(candidate), Addr: candidate})
+}
+
+// handOffRange shares the files of a range with the predecessor that took it
+// over. It runs in the background, so that the Notify the predecessor is
+// waiting on returns right away, and stops when the node shuts down.
+// Handoffs run one at a time, in the order the predecessors were adopted.
+func (n *Node) handOffRange(sf ShareFilesReq) {
+	n.handoffs.Add(1)
+	n.pending.Add(1)
+	go func() {
+		defer n.handoffs.Done()
+		defer n.pending.Add(-1)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			select {
+			case <-n.quit:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+
+		n.muhandoff.Lock()
+		defer n.muhandoff.Unlock()
+
+		if err := n.shareFiles(ctx, sf, n.caller); err != nil {
+			log.Println("ShareFiles", err)
+		}
+	}()
+}
+
+// handOffStray hands the files outside our range over to the predecessor,
+// which redirects us to their owners. They are left behind when nodes join
+// while a handoff is under way, so there is nothing to do until the pending
+// handoffs are through.
+func (n *Node) handOffStray() {
+	pred := n.getPred()
+	if pred == n.Addr || n.pending.Load() > 0 {
+		return
+	}
+
+	for fileid := range n.files() {
+		if !betweenRight(fileid, n.hash(pred), n.id()) {
+			n.handOffRange(ShareFilesReq{PredID: n.id(), ID: n.hash(pred), Addr: pred})
+			return
+		}
+	}
+}
+
+// fixFingers refreshes the next finger table entry, one entry per call.
+func (n *Node) fixFingers(ctx context.Context, caller Caller) {
+	n.mufing.Lock()
+	n.next = (n.next + 1) % len(n.fingerTable)
+	next := n.next
+	n.mufing.Unlock()
+
+	lr := n.find(ctx, n.id().fingerStart(uint(next), n.bits), caller)
+	if lr.Addr == "" {
+		return
+	}
+
+	n.setFinger(next, lr.Addr)
+}
+
+// checkPred clears the predecessor (points it back at ourselves) when it no
+// longer answers, so that notify can accept a replacement.
+func (n *Node) checkPred(ctx context.Context, caller Caller) {
+	pred := n.getPred()
+	if pred == n.Addr {
+		return
+	}
+
+	var empty string
+	if err := n.call(ctx, caller, pred, "Ping", empty, &empty); err != nil {
+		log.Printf("predecessor (%v) of ID (%v) is unreachable: %v", pred, n.hash(pred), err)
+
+		// Leave a predecessor adopted in the meantime alone.
+		n.muroute.Lock()
+		if n.Predecessor == pred {
+			n.Predecessor = n.Addr
+		}
+		n.muroute.Unlock()
+	}
+}
+
+// between reports whether id lies in the open interval (from, to) on the
+// identifier circle. When from == to the interval covers the whole circle
+// except from itself.
+func between(id, from, to Key) bool {
+	if from.Cmp(to) < 0 {
+		return from.Cmp(id) < 0 && id.Cmp(to) < 0
+	}
+
+	return from.Cmp(id) < 0 || id.Cmp(to) < 0
+}
+
+// betweenRight reports whether id lies in the half-open interval (from, to]
+// on the identifier circle. When from == to the interval covers the whole
+// circle.
+func betweenRight(id, from, to Key) bool {
+	return id == to || between(id, from, to)
+}
+
+// responsible reports whether id falls into our range (pred, self]. With no
+// known predecessor every key does.
+func (n *Node) responsible(id Key) bool {
+	return betweenRight(id, n.hash(n.getPred()), n.id())
+}
+
+// checkResponsible returns a CodeNotResponsible error naming the node to try
+// instead unless id falls into our range. A stale lookup would otherwise
+// store a file where no lookup finds it again.
+func (n *Node) checkResponsible(ctx context.Context, id Key, caller Caller) error {
+	if n.responsible(id) {
+		return nil
+	}
+
+	// A lookup ending at ourselves means the ring is not settled yet, and
+	// the key precedes our range, so our predecessor is the better guess.
+	addr := n.find(ctx, id, caller).Addr
+	if addr == "" || addr == n.Addr {
+		addr = n.getPred()
+	}
+
+	return &Error{Code: CodeNotResponsible, Message: fmt.Sprintf("key (%v) is outside the range of (%v)", id, n.Addr), Addr: addr}
 }
 
 func (n *Node) retrieveFile(rf RetrieveFileReq) (*RetrieveFileResp, error) {
 	n.mufile.Lock()
 	defer n.mufile.Unlock()
 
-	content, err := ioutil.ReadFile(filepath.Join(strconv.FormatUint(n.id(), 10), rf.Filename))
+	f, fi, err := n.store.Get(rf.Filename)
 	if err != nil {
 		return nil, err
 	}
+	defer f.Close()
+
+	if rf.Length <= 0 || rf.Length > chunkSize {
+		rf.Length = chunkSize
+	}
+
+	if _, err := f.Seek(rf.Offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	content := make([]byte, rf.Length)
+	read, err := io.ReadFull(f, content)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
 
-	return &RetrieveFileResp{Filename: rf.Filename, Content: content, ID: ID(rf.Filename)}, nil
+	return &RetrieveFileResp{Filename: rf.Filename, Content: content[:read], ID: n.hash(rf.Filename), Size: fi.Size, Checksum: fi.Checksum}, nil
 }
 
 func (n *Node) RetrieveFile(rf RetrieveFileReq, rfr *RetrieveFileResp) error {
+	name, err := n.resolveName(rf.Owner, rf.Filename, rf.ID)
+	if err != nil {
+		return rpcError(err)
+	}
+	rf.Filename = name
+
+	if !rf.Replica {
+		if err := n.checkResponsible(context.Background(), rf.ID, n.caller); err != nil {
+			return err
+		}
+	}
+
 	rfrr, err := n.retrieveFile(rf)
 	if err != nil {
-		rfr.Err = err
-		return err
+		return rpcError(err)
 	}
 
 	rfr.Content = rfrr.Content
 	rfr.Filename = rfrr.Filename
 	rfr.ID = rfrr.ID
+	rfr.Size = rfrr.Size
+	rfr.Checksum = rfrr.Checksum
 
 	return nil
 }
 
+// uploadFile stores a file sent in a single request.
 func (n *Node) uploadFile(uf UploadFileReq) error {
-	n.mufile.Lock()
-	defer n.mufile.Unlock()
+	uf.Size = int64(len(uf.Content))
 
-	if err := os.MkdirAll(strconv.FormatUint(n.id(), 10), 0700); err != nil {
+	if _, err := n.beginUpload(uf); err != nil {
 		return err
 	}
 
-	f, err := os.OpenFile(filepath.Join(strconv.FormatUint(n.id(), 10), uf.Filename), os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		return err
+	n.mufile.Lock()
+	err := ioutil.WriteFile(n.spoolPath(uf.ID), uf.Content, 0644)
+	n.mufile.Unlock()
+	if err == nil {
+		err = n.commitUpload(uf)
 	}
-
-	if _, err := f.Write(uf.Content); err != nil {
-		return err
+	// Unlike a chunked upload, this one cannot be resumed.
+	if err != nil {
+		n.abortUpload(uf.ID)
 	}
 
-	n.fileTable[uf.ID] = uf.Filename
-
-	return nil
+	return err
 }
 
-func (n *Node) shareFiles(sf ShareFilesReq, client Caller) error {
-	n.mufile.Lock()
-	defer n.mufile.Unlock()
-
-	id := n.id()
-	for fileid, filename := range n.fileTable {
-
-		switch {
-		case sf.PredID < fileid && fileid <= sf.ID:
-		case sf.PredID > sf.ID && sf.PredID < fileid:
-		case sf.PredID > sf.ID && fileid <= sf.ID:
-		default:
+func (n *Node) shareFiles(ctx context.Context, sf ShareFilesReq, client Caller) error {
+	for fileid, filename := range n.files() {
+		if !betweenRight(fileid, sf.PredID, sf.ID) {
 			continue
 		}
 
-		buff, err := ioutil.ReadFile(filepath.Join(strconv.FormatUint(id, 10), filename))
+		// The handoff runs after the predecessor was adopted, and nodes
+		// may have joined in between since. They redirect us then.
+		err := n.sendFile(ctx, client, sf.Addr, fileid, filename, false)
+		if to, ok := redirect(err); ok && to != n.Addr {
+			err = n.sendFile(ctx, client, to, fileid, filename, false)
+		}
 		if err != nil {
 			log.Println(err)
 			continue
 		}
 
-		client.Call(sf.Addr, "UploadFile", UploadFileReq{
-			Filename: filename,
-			Content:  buff,
-			ID:       fileid,
-		}, &UploadFileResp{})
+		n.mufile.Lock()
+		delete(n.fileTable, fileid)
+
+		// We are the new node's successor, so we keep a replica of what we
+		// handed over as long as replication is enabled.
+		if n.replicas > 1 {
+			n.replicaTable[fileid] = filename
+			n.mufile.Unlock()
+			continue
+		}
+		n.mufile.Unlock()
 
-		if err := os.Remove(filepath.Join(strconv.FormatUint(n.id(), 10), filename)); err != nil {
+		if err := n.store.Delete(filename); err != nil {
 			log.Println(err)
 			continue
 		}
 
-		delete(n.fileTable, fileid)
+		n.mufile.Lock()
+		n.usage.removed(filename)
+		n.mufile.Unlock()
 	}
 
-	return nil
+	return n.saveState()
 }
 
-func (n *Node) ShareFiles(sf ShareFilesReq, sfr *ShareFilesResp) error {
-	if err := n.shareFiles(sf, NewRPCCaller()); err != nil {
-		sfr.Err = err
-		return err
+// files returns a snapshot of the files this node is responsible for.
+func (n *Node) files() map[Key]string {
+	n.mufile.Lock()
+	defer n.mufile.Unlock()
+
+	files := make(map[Key]string, len(n.fileTable))
+	for fileid, filename := range n.fileTable {
+		files[fileid] = filename
 	}
 
-	return nil
+	return files
+}
+
+func (n *Node) ShareFiles(sf ShareFilesReq, empty *string) error {
+	return rpcError(n.shareFiles(context.Background(), sf, n.caller))
 }
 
 func (n *Node) UploadFile(uf UploadFileReq, ufr *UploadFileResp) error {
+	name, err := n.resolveName(uf.Owner, uf.Filename, uf.ID)
+	if err != nil {
+		return rpcError(err)
+	}
+	uf.Filename = name
+
+	if !uf.Replica {
+		if err := n.checkResponsible(context.Background(), uf.ID, n.caller); err != nil {
+			return err
+		}
+	}
+
 	if err := n.uploadFile(uf); err != nil {
-		ufr.Err = err
-		return err
+		return rpcError(err)
 	}
 
-	return nil
-}
+	if err := n.saveState(); err != nil {
+		log.Println("saving node state:", err)
+	}
+
+	if !uf.Replica {
+		n.replicate(context.Background(), uf, n.caller)
+	}
 
-func (n *Node) Stabilize(origin string, empty *string) error {
-	return n.stabilize(origin, NewRPCCaller())
+	ufr.Checksum = uf.Checksum
+	return nil
 }
 
-func (n *Node) Lookup(id uint64, lr *LookupResp) error {
-	llr := n.lookup(id, NewRPCCaller())
+func (n *Node) Lookup(id Key, lr *LookupResp) error {
+	llr := n.lookup(context.Background(), id, n.caller)
+	if llr.Addr == "" {
+		return lookupFailed(id)
+	}
 
 	lr.Addr = llr.Addr
 	lr.ID = llr.ID
 	return nil
 }
 
-func (n *Node) SetSucc(succ string, ssr *SetSuccResp) error {
-	n.setSucc(succ)
-
-	ssr.Addr = succ
-	ssr.ID = ID(succ)
+func (n *Node) LookupIterative(id Key, lr *LookupResp) error {
+	*lr = n.lookupIterative(context.Background(), id, n.caller)
+	if lr.Addr == "" {
+		return lookupFailed(id)
+	}
 
 	return nil
 }
 
-func (n *Node) SetPred(pred string, spr *SetPredResp) error {
-	n.setPred(pred)
-
-	spr.Addr = pred
-	spr.ID = ID(pred)
+// lookupFailed is returned by the lookup RPCs when no node on the way could
+// resolve id.
+func lookupFailed(id Key) error {
+	return &Error{Code: CodeUnavailable, Message: fmt.Sprintf("lookup of key (%v) failed", id)}
+}
 
+func (n *Node) ClosestPreceding(id Key, cpr *ClosestPrecedingResp) error {
+	*cpr = n.closestPreceding(id)
 	return nil
 }
 
@@ -466,7 +1223,13 @@ func (n *Node) GetSucc(empty string, gsr *GetSuccResp) error {
 	addr := n.getSucc()
 
 	gsr.Addr = addr
-	gsr.ID = ID(addr)
+	gsr.ID = n.hash(addr)
+
+	return nil
+}
+
+func (n *Node) GetSuccList(empty string, gslr *GetSuccListResp) error {
+	gslr.Addrs = n.getSuccList()
 
 	return nil
 }
@@ -475,49 +1238,52 @@ func (n *Node) GetPred(empty string, gpr *GetPredResp) error {
 	addr := n.getPred()
 
 	gpr.Addr = addr
-	gpr.ID = ID(addr)
+	gpr.ID = n.hash(addr)
+
+	return nil
+}
+
+func (n *Node) Depart(dr DepartReq, empty *string) error {
+	n.depart(dr)
+	return nil
+}
+
+func (n *Node) Notify(addr string, empty *string) error {
+	n.notify(addr)
+	return nil
+}
+
+func (n *Node) Ping(empty string, reply *string) error {
+	return nil
+}
 
+func (n *Node) Ring(empty string, rr *RingResp) error {
+	rr.Bits = n.bits
+	rr.Addr = n.Addr
 	return nil
 }
 
 func (n *Node) CalcFingerTable(empty string, emptyreply *string) error {
-	n.calcFingerTable()
+	n.calcFingerTable(context.Background(), n.caller)
 	return nil
 }
 
 func (n *Node) printFingerTable() {
-	fmt.Println("i  | address        | ID")
-	for i := 0; i < len(n.fingerTable); i++ {
-		fmt.Printf("%02d (%7d) | %v | %7d\n", i, (n.id()+uint64(math.Pow(2, float64(i))))%1048576, n.fingerTable[i], ID(n.fingerTable[i]))
+	fmt.Println("i   | address        | ID")
+	for i, finger := range n.fingers() {
+		fmt.Printf("%03d (%7v) | %v | %7v\n", i, n.id().fingerStart(uint(i), n.bits), finger, n.hash(finger))
 	}
 }
 
 func (n *Node) printFileTable() {
+	n.mufile.Lock()
+	defer n.mufile.Unlock()
+
 	fmt.Println("Key     | Filename")
 	for fileid, filename := range n.fileTable {
-		fmt.Printf("(%7d) | %v\n", fileid, filename)
+		fmt.Printf("(%7v) | %v\n", fileid, filename)
 	}
-}
-
-type RPCCaller struct{}
-
-func (rc *RPCCaller) Call(addr, proc string, args interface{}, reply interface{}) error {
-	conn, err := rpc.Dial("tcp4", addr)
-	if err != nil {
-		return err
-	}
-
-	if err := conn.Call("Node."+proc, args, reply); err != nil {
-		return err
+	for fileid, filename := range n.replicaTable {
+		fmt.Printf("(%7v) | %v (replica)\n", fileid, filename)
 	}
-
-	if err := conn.Close(); err != nil {
-		return err
-	}
-
-	return nil
-}
-
-func NewRPCCaller() *RPCCaller {
-	return &RPCCaller{}
 }
@@ -1,7 +1,15 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/rpc"
+	"sort"
 	"testing"
+	"testing/quick"
 )
 
 func NewMockCaller(succ, succspred string) *MockCaller {
@@ -20,35 +28,351 @@ func (mc *MockCaller) Call(addr, proc string, args interface{}, reply interface{
 	case "Lookup":
 		lr := reply.(*LookupResp)
 		lr.Addr = "localhost:8085"
+	case "Ring":
+		rr := reply.(*RingResp)
+		rr.Bits = defaultBits
 	case "GetPred":
 		gpr := reply.(*GetPredResp)
 		gpr.Addr = "localhost:8070"
-	case "SetSucc":
-		// ssr := reply.(*SetSuccResp)
-		// ssr.Addr = "localhost:8085"
-	case "SetPred":
-		// spr := reply.(*SetPredResp)
-		// spr.Addr = "localhost:8085"
 	}
 	return nil
 }
 
+func (mc *MockCaller) CallContext(ctx context.Context, addr, proc string, args interface{}, reply interface{}) error {
+	return mc.Call(addr, proc, args, reply)
+}
+
 func TestNodeJoin(t *testing.T) {
 	self := "localhost:8080"
 	introducer := "localhost:8081"
 	succ := "localhost:8085"
 	succspred := "localhost:8070"
 
-	n := NewNode(self)
+	n := NewNode(self, Config{})
 	mc := NewMockCaller(succ, succspred)
 
-	n.join(introducer, mc)
+	if err := n.join(context.Background(), introducer, mc); err != nil {
+		t.Fatal(err)
+	}
 
 	if n.Successor != succ {
 		t.Errorf("successor is wrong. Expected (%v), found (%v)", succ, n.Successor)
 	}
 
-	if n.Predecessor != succspred {
-		t.Errorf("successor is wrong. Expected (%v), found (%v)", succspred, n.Predecessor)
+	// The predecessor is only learned once it notifies us.
+	if n.Predecessor != self {
+		t.Errorf("predecessor is wrong. Expected (%v), found (%v)", self, n.Predecessor)
+	}
+
+	notified := false
+	for _, c := range mc.calls {
+		switch c[1] {
+		case "SetSucc", "SetPred":
+			t.Errorf("join must not overwrite the pointers of other nodes, found call (%v)", c)
+		case "Notify":
+			notified = c[0] == succ
+		}
+	}
+	if !notified {
+		t.Errorf("Expected the successor to be notified, found calls (%v)", mc.calls)
+	}
+}
+
+func TestNodeJoinRingMismatch(t *testing.T) {
+	n := NewNode("localhost:8080", Config{Bits: 32})
+	mc := NewMockCaller("localhost:8085", "localhost:8070")
+
+	if err := n.join(context.Background(), "localhost:8081", mc); err == nil {
+		t.Errorf("joining a ring of a different size should fail")
+	}
+
+	if len(mc.calls) != 1 {
+		t.Errorf("expected only the ring size check, found calls (%v)", mc.calls)
+	}
+}
+
+func TestNodeNotify(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	self := "localhost:8080"
+	n := NewNode(self, Config{})
+
+	n.notify("localhost:8085")
+	if n.Predecessor != "localhost:8085" {
+		t.Errorf("predecessor is wrong. Expected (%v), found (%v)", "localhost:8085", n.Predecessor)
+	}
+
+	n.notify(self)
+	if n.Predecessor != "localhost:8085" {
+		t.Errorf("predecessor is wrong. Expected (%v), found (%v)", "localhost:8085", n.Predecessor)
+	}
+
+	n.handoffs.Wait()
+}
+
+func TestBetween(t *testing.T) {
+	cases := []struct {
+		id, from, to int64
+		want         bool
+	}{
+		{5, 1, 10, true},
+		{1, 1, 10, false},
+		{10, 1, 10, false},
+		{2, 10, 5, true},
+		{11, 10, 5, true},
+		{7, 10, 5, false},
+		{3, 7, 7, true},
+		{7, 7, 7, false},
+	}
+
+	for _, c := range cases {
+		if got := between(testKey(c.id), testKey(c.from), testKey(c.to)); got != c.want {
+			t.Errorf("between(%v, %v, %v) = %v, expected %v", c.id, c.from, c.to, got, c.want)
+		}
+	}
+}
+
+func TestNodeSuccList(t *testing.T) {
+	self := "localhost:8080"
+	n := NewNode(self, Config{SuccListLen: 3})
+
+	n.updateSuccList("localhost:8081", []string{"localhost:8082", "localhost:8083", "localhost:8084"})
+	if got := n.getSuccList(); len(got) != 3 || got[0] != "localhost:8081" || got[2] != "localhost:8083" {
+		t.Errorf("successor list is wrong. Found (%v)", got)
+	}
+
+	n.updateSuccList("localhost:8081", []string{"localhost:8082", self, "localhost:8081"})
+	if got := n.getSuccList(); len(got) != 2 {
+		t.Errorf("successor list should stop at self. Found (%v)", got)
+	}
+
+	n.succFailed("localhost:8081")
+	if n.Successor != "localhost:8082" {
+		t.Errorf("successor is wrong. Expected (%v), found (%v)", "localhost:8082", n.Successor)
+	}
+
+	n.succFailed("localhost:8082")
+	if n.Successor != self {
+		t.Errorf("successor is wrong. Expected (%v), found (%v)", self, n.Successor)
+	}
+}
+
+func TestNodePromoteReplicas(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	n := NewNode("localhost:8080", Config{})
+	id := n.id()
+
+	n.replicaTable[id.Add(big.NewInt(1), n.bits)] = "theirs"
+	n.replicaTable[id.Add(big.NewInt(-1), n.bits)] = "ours"
+
+	n.promoteReplicas(id.Add(big.NewInt(-10), n.bits))
+
+	if _, ok := n.fileTable[id.Add(big.NewInt(-1), n.bits)]; !ok {
+		t.Errorf("replica in our range was not promoted")
+	}
+
+	if _, ok := n.replicaTable[id.Add(big.NewInt(1), n.bits)]; !ok {
+		t.Errorf("replica outside our range was promoted")
+	}
+}
+
+// ringCaller dispatches lookups directly to the nodes of a simulated ring.
+type ringCaller struct {
+	nodes map[string]*Node
+	hops  int
+}
+
+func (rc *ringCaller) Call(addr, proc string, args interface{}, reply interface{}) error {
+	return rc.CallContext(context.Background(), addr, proc, args, reply)
+}
+
+func (rc *ringCaller) CallContext(ctx context.Context, addr, proc string, args interface{}, reply interface{}) error {
+	n, ok := rc.nodes[addr]
+	if !ok {
+		return &net.OpError{Op: "dial", Net: "tcp4", Err: errors.New("no such node")}
+	}
+
+	rc.hops++
+	switch proc {
+	case "Lookup":
+		return n.Lookup(args.(Key), reply.(*LookupResp))
+	case "ClosestPreceding":
+		return n.ClosestPreceding(args.(Key), reply.(*ClosestPrecedingResp))
+	}
+
+	return fmt.Errorf("unsupported procedure (%v)", proc)
+}
+
+// newTestRing builds a correctly wired ring of size nodes, sorted by ID. The
+// finger tables are only filled in when fingers is set.
+func newTestRing(size int, bits uint, fingers bool) (*ringCaller, []*Node) {
+	rc := &ringCaller{nodes: make(map[string]*Node)}
+
+	var nodes []*Node
+	ids := make(map[Key]bool)
+	for i := 0; len(nodes) < size; i++ {
+		n := NewNode(fmt.Sprintf("10.0.%d.%d:8080", i/256, i%256), Config{Bits: bits, Caller: rc})
+		if ids[n.id()] {
+			continue
+		}
+
+		ids[n.id()] = true
+		rc.nodes[n.Addr] = n
+		nodes = append(nodes, n)
+	}
+
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].id().Cmp(nodes[j].id()) < 0 })
+
+	for i, n := range nodes {
+		n.setPred(nodes[(i+size-1)%size].Addr)
+
+		var succs []string
+		for j := 1; j <= n.succListLen; j++ {
+			succs = append(succs, nodes[(i+j)%size].Addr)
+		}
+		n.updateSuccList(succs[0], succs[1:])
+
+		if fingers {
+			for f := range n.fingers() {
+				n.setFinger(f, trueSucc(nodes, n.id().fingerStart(uint(f), bits)))
+			}
+		}
+	}
+
+	return rc, nodes
+}
+
+// trueSucc returns the node responsible for id in a ring sorted by ID.
+func trueSucc(nodes []*Node, id Key) string {
+	for _, n := range nodes {
+		if n.id().Cmp(id) >= 0 {
+			return n.Addr
+		}
+	}
+
+	return nodes[0].Addr
+}
+
+func TestLookupResolvesTrueSuccessor(t *testing.T) {
+	for _, c := range []struct {
+		bits    uint
+		fingers bool
+	}{
+		{defaultBits, true},
+		{defaultBits, false},
+		{maxBits, true},
+	} {
+		rc, nodes := newTestRing(64, c.bits, c.fingers)
+
+		prop := func(key [20]byte, from uint8) bool {
+			id := Key(key).mask(c.bits)
+			n := nodes[int(from)%len(nodes)]
+
+			lr := n.lookup(context.Background(), id, rc)
+			return lr.Addr == trueSucc(nodes, id) && lr.ID == n.hash(lr.Addr)
+		}
+
+		if err := quick.Check(prop, &quick.Config{MaxCount: 500}); err != nil {
+			t.Errorf("bits (%v), fingers (%v): %v", c.bits, c.fingers, err)
+		}
+	}
+}
+
+func TestLookupIterative(t *testing.T) {
+	rc, nodes := newTestRing(64, defaultBits, true)
+
+	prop := func(key [20]byte, from uint8) bool {
+		id := Key(key).mask(defaultBits)
+		n := nodes[int(from)%len(nodes)]
+
+		rc.hops = 0
+		lr := n.lookupIterative(context.Background(), id, rc)
+		if len(lr.Hops) != rc.hops {
+			return false
+		}
+
+		return lr.Addr == trueSucc(nodes, id) && lr.ID == n.hash(lr.Addr)
+	}
+
+	if err := quick.Check(prop, &quick.Config{MaxCount: 500}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLookupIsLogarithmic(t *testing.T) {
+	rc, nodes := newTestRing(256, defaultBits, true)
+
+	for _, n := range nodes {
+		rc.hops = 0
+		id := n.id().fingerStart(defaultBits-1, defaultBits).Add(big.NewInt(7), defaultBits)
+		if lr := n.lookup(context.Background(), id, rc); lr.Addr != trueSucc(nodes, id) {
+			t.Fatalf("lookup of (%v) from (%v) found (%v), expected (%v)", id, n.Addr, lr.Addr, trueSucc(nodes, id))
+		}
+
+		// log2(256) = 8 hops at most with correct finger tables.
+		if rc.hops > 8 {
+			t.Errorf("lookup of (%v) from (%v) took (%v) hops", id, n.Addr, rc.hops)
+		}
+	}
+}
+
+func TestBetweenRight(t *testing.T) {
+	cases := []struct {
+		id, from, to int64
+		want         bool
+	}{
+		{10, 1, 10, true},
+		{1, 1, 10, false},
+		{5, 10, 5, true},
+		{10, 10, 5, false},
+		{7, 7, 7, true},
+		{3, 7, 7, true},
+	}
+
+	for _, c := range cases {
+		if got := betweenRight(testKey(c.id), testKey(c.from), testKey(c.to)); got != c.want {
+			t.Errorf("betweenRight(%v, %v, %v) = %v, expected %v", c.id, c.from, c.to, got, c.want)
+		}
+	}
+}
+
+func testKey(v int64) Key {
+	return KeyFromInt(big.NewInt(v), defaultBits)
+}
+
+func TestNodeServeShutdown(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n := NewNode(ln.Addr().String(), Config{})
+	if err := rpc.Register(n); err != nil {
+		t.Fatal(err)
+	}
+
+	served := make(chan struct{})
+	go func() {
+		n.serve(ln)
+		close(served)
+	}()
+
+	rc := NewRPCCaller()
+	defer rc.Close()
+
+	var rr RingResp
+	if err := rc.Call(n.Addr, "Ring", "", &rr); err != nil {
+		t.Fatal(err)
+	}
+
+	n.shutdown()
+	n.shutdown()
+	<-served
+
+	if err := rc.Call(n.Addr, "Ring", "", &rr); err == nil {
+		t.Errorf("Expected calls to fail once the node shut down")
 	}
 }
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// QuotaError is returned when storing a file would take a node over one of
+// its quotas. It reaches the uploader as an Error of code CodeQuotaExceeded.
+type QuotaError struct {
+	// Resource is QuotaBytes or QuotaFiles.
+	Resource  string
+	Limit     int64
+	Used      int64
+	Requested int64
+}
+
+const (
+	QuotaBytes = "bytes"
+	QuotaFiles = "files"
+)
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("quota exceeded: storing %d more %v would use %d of %d", e.Requested, e.Resource, e.Used+e.Requested, e.Limit)
+}
+
+// usage tracks what the store holds and what the uploads in progress are
+// about to add, so that quotas are checked without listing the store. It is
+// guarded by n.mufile.
+type usage struct {
+	// sizes holds the size of every stored file by name.
+	sizes map[string]int64
+	bytes int64
+	// reserved holds the uploads begun but not committed yet.
+	reserved map[Key]reservation
+}
+
+type reservation struct {
+	name    string
+	size    int64
+	expires time.Time
+}
+
+func newUsage() *usage {
+	return &usage{sizes: make(map[string]int64), reserved: make(map[Key]reservation)}
+}
+
+// stored records that name now holds size bytes.
+func (u *usage) stored(name string, size int64) {
+	u.bytes += size - u.sizes[name]
+	u.sizes[name] = size
+}
+
+// removed records that name is gone.
+func (u *usage) removed(name string) {
+	u.bytes -= u.sizes[name]
+	delete(u.sizes, name)
+}
+
+// reserve sets aside room for the upload of key id until it is released or
+// expires.
+func (u *usage) reserve(id Key, name string, size int64, expires time.Time) {
+	u.reserved[id] = reservation{name: name, size: size, expires: expires}
+}
+
+func (u *usage) release(id Key) {
+	delete(u.reserved, id)
+}
+
+// expired returns the keys of the reservations that expired by now.
+func (u *usage) expired(now time.Time) []Key {
+	var keys []Key
+	for id, r := range u.reserved {
+		if now.After(r.expires) {
+			keys = append(keys, id)
+		}
+	}
+
+	return keys
+}
+
+// checkQuota reports whether name can be stored with the given size by the
+// upload of key id. A file of the same name is about to be replaced, so it
+// does not count, while the uploads in progress do. The caller holds
+// n.mufile.
+func (n *Node) checkQuota(id Key, name string, size int64) error {
+	if n.maxBytes <= 0 && n.maxFiles <= 0 {
+		return nil
+	}
+
+	u := n.usage
+	used, files := u.bytes, int64(len(u.sizes))
+	if old, ok := u.sizes[name]; ok {
+		used -= old
+		files--
+	}
+	now := time.Now()
+	for rid, r := range u.reserved {
+		// Expired uploads are aborted on the next tick, and do not
+		// stand in the way until then.
+		if rid == id || now.After(r.expires) {
+			continue
+		}
+		used += r.size
+		if _, ok := u.sizes[r.name]; !ok {
+			files++
+		}
+	}
+
+	if n.maxBytes > 0 && used+size > n.maxBytes {
+		return &QuotaError{Resource: QuotaBytes, Limit: n.maxBytes, Used: used, Requested: size}
+	}
+	if n.maxFiles > 0 && files+1 > int64(n.maxFiles) {
+		return &QuotaError{Resource: QuotaFiles, Limit: int64(n.maxFiles), Used: files, Requested: 1}
+	}
+
+	return nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNodeQuota(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	for _, filename := range []string{"a", "b", "c"} {
+		if err := ioutil.WriteFile(filename, []byte("123456"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		cfg      Config
+		resource string
+	}{
+		{"bytes", Config{MaxBytes: 10}, QuotaBytes},
+		{"files", Config{MaxFiles: 1}, QuotaFiles},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.cfg.Store = NewMemStore()
+			n := NewNode("localhost:8080", test.cfg)
+			call := directCall(n, make(map[string]int))
+
+			if _, err := pushFile(call, "a", UploadFileReq{ID: n.hash("a"), Filename: "a"}); err != nil {
+				t.Fatal(err)
+			}
+
+			// Replacing a stored file does not count twice.
+			if _, err := pushFile(call, "a", UploadFileReq{ID: n.hash("a"), Filename: "a"}); err != nil {
+				t.Errorf("Expected (a) to be replaced, found (%v)", err)
+			}
+
+			_, err := pushFile(call, "b", UploadFileReq{ID: n.hash("b"), Filename: "b"})
+			if codeOf(err) != CodeQuotaExceeded || !strings.Contains(err.Error(), test.resource) {
+				t.Fatalf("Expected a (%v) quota error, found (%v)", test.resource, err)
+			}
+
+			if _, ok := n.fileTable[n.hash("b")]; ok {
+				t.Errorf("Expected (b) to be refused, found it stored")
+			}
+		})
+	}
+}
+
+func TestNodeDataDir(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	a := NewNode("localhost:8080", Config{DataDir: "a"})
+	b := NewNode("localhost:8080", Config{DataDir: "b"})
+
+	sum, _ := checksum(bytes.NewReader([]byte("x")))
+	if err := a.uploadFile(UploadFileReq{ID: a.hash("x"), Filename: "x", Content: []byte("x"), Checksum: sum}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join("a", a.id().String(), "x")); err != nil {
+		t.Errorf("Expected (x) under the data directory, found (%v)", err)
+	}
+	if _, err := b.store.Stat("x"); !os.IsNotExist(err) {
+		t.Errorf("Expected nodes with different data directories not to share files, found (%v)", err)
+	}
+}
+
+// TestNodeQuotaReserve checks that uploads in progress count against the
+// quota and that deletions give the room back.
+func TestNodeQuotaReserve(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	n := NewNode("localhost:8080", Config{MaxBytes: 10, Store: NewMemStore()})
+
+	a := UploadFileReq{ID: n.hash("a"), Filename: "a", Size: 6}
+	if _, err := n.beginUpload(a); err != nil {
+		t.Fatal(err)
+	}
+
+	b := UploadFileReq{ID: n.hash("b"), Filename: "b", Size: 6}
+	if _, err := n.beginUpload(b); codeOf(err) != CodeQuotaExceeded {
+		t.Fatalf("Expected a quota error while (a) is uploading, found (%v)", err)
+	}
+
+	a.Content = []byte("123456")
+	a.Checksum, _ = checksum(bytes.NewReader(a.Content))
+	if err := n.uploadFile(a); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := n.beginUpload(b); codeOf(err) != CodeQuotaExceeded {
+		t.Fatalf("Expected a quota error with (a) stored, found (%v)", err)
+	}
+
+	if err := n.deleteFile(a.ID, "a", false, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := n.beginUpload(b); err != nil {
+		t.Errorf("Expected (b) to fit once (a) is deleted, found (%v)", err)
+	}
+}
+
+// TestNodeQuotaExpire checks that an abandoned upload gives its room back
+// once it expires.
+func TestNodeQuotaExpire(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	n := NewNode("localhost:8080", Config{MaxBytes: 100, Store: NewMemStore()})
+
+	a := UploadFileReq{ID: n.hash("a"), Filename: "a", Size: 100}
+	if _, err := n.beginUpload(a); err != nil {
+		t.Fatal(err)
+	}
+
+	b := UploadFileReq{ID: n.hash("b"), Filename: "b", Size: 1}
+	if _, err := n.beginUpload(b); codeOf(err) != CodeQuotaExceeded {
+		t.Fatalf("Expected a quota error while (a) is uploading, found (%v)", err)
+	}
+
+	r := n.usage.reserved[a.ID]
+	r.expires = time.Now().Add(-time.Second)
+	n.usage.reserved[a.ID] = r
+
+	if _, err := n.beginUpload(b); err != nil {
+		t.Errorf("Expected (b) to fit once (a) expired, found (%v)", err)
+	}
+
+	n.expireUploads()
+	if _, ok := n.usage.reserved[a.ID]; ok {
+		t.Errorf("Expected the upload of (a) to be aborted, found it reserved")
+	}
+	if _, err := os.Stat(n.spoolPath(a.ID)); !os.IsNotExist(err) {
+		t.Errorf("Expected the spool file of (a) to be removed, found (%v)", err)
+	}
+	if _, ok := n.usage.reserved[b.ID]; !ok {
+		t.Errorf("Expected the upload of (b) to be kept")
+	}
+}
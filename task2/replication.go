@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+)
+
+// replicaTargets returns the successors that should hold replicas of the
+// files this node is responsible for.
+func (n *Node) replicaTargets() []string {
+	var targets []string
+	for _, s := range n.getSuccList() {
+		if len(targets) == n.replicas-1 {
+			break
+		}
+		if s != n.Addr {
+			targets = append(targets, s)
+		}
+	}
+
+	return targets
+}
+
+// replicate pushes a freshly uploaded primary copy to the replica targets.
+func (n *Node) replicate(ctx context.Context, uf UploadFileReq, caller Caller) {
+	for _, addr := range n.replicaTargets() {
+		if err := n.sendFile(ctx, caller, addr, uf.ID, uf.Filename, true); err != nil {
+			log.Printf("replicating file (%v) to (%v): %v", uf.Filename, addr, err)
+		}
+	}
+}
+
+// checkReplicas re-creates replicas on successors that joined the replica
+// set since the last round, e.g. after a successor crashed or a node joined
+// right after us, and has successors that left the set drop theirs.
+func (n *Node) checkReplicas(ctx context.Context, caller Caller) {
+	targets := n.replicaTargets()
+
+	n.mufile.Lock()
+	var fresh, stale []string
+	for _, t := range targets {
+		if !contains(n.replicatedTo, t) {
+			fresh = append(fresh, t)
+		}
+	}
+	for _, t := range n.replicatedTo {
+		if !contains(targets, t) {
+			stale = append(stale, t)
+		}
+	}
+	n.mufile.Unlock()
+
+	if len(fresh) == 0 && len(stale) == 0 {
+		n.setReplicatedTo(targets)
+		return
+	}
+
+	files := n.files()
+	for _, addr := range stale {
+		n.dropReplicas(ctx, caller, addr, files)
+	}
+
+	for fileid, filename := range files {
+		for _, addr := range fresh {
+			if err := n.sendFile(ctx, caller, addr, fileid, filename, true); err != nil {
+				log.Printf("replicating file (%v) to (%v): %v", filename, addr, err)
+				return
+			}
+		}
+	}
+
+	if len(fresh) != 0 {
+		log.Printf("replicated %d files to %v", len(files), fresh)
+	}
+	n.setReplicatedTo(targets)
+}
+
+// dropReplicas has addr delete its replicas of files, as it no longer is a
+// replica target. Left in place, they would count against its quota and be
+// promoted again should its range grow.
+func (n *Node) dropReplicas(ctx context.Context, caller Caller, addr string, files map[Key]string) {
+	for fileid, name := range files {
+		owner, filename := splitFileName(name)
+		df := DeleteFileReq{Filename: filename, Owner: owner, ID: fileid, Replica: true}
+		if err := n.call(ctx, caller, addr, "DeleteFile", df, new(string)); err != nil {
+			log.Printf("dropping replica of file (%v) on (%v): %v", name, addr, err)
+			if unreachable(err) {
+				return
+			}
+		}
+	}
+
+	log.Printf("dropped replicas of %d files on (%v)", len(files), addr)
+}
+
+// replicatesTo reports whether our files were last replicated to addr.
+func (n *Node) replicatesTo(addr string) bool {
+	n.mufile.Lock()
+	defer n.mufile.Unlock()
+
+	return contains(n.replicatedTo, addr)
+}
+
+func (n *Node) setReplicatedTo(targets []string) {
+	n.mufile.Lock()
+	defer n.mufile.Unlock()
+
+	n.replicatedTo = targets
+}
+
+// promoteReplicas takes over the replicas whose keys now fall into our range
+// (predID, self], which happens when our predecessor crashed. Promoted files
+// get pushed to all replica targets on the next round. Replicas of deleted
+// files are dropped instead.
+func (n *Node) promoteReplicas(predID Key) {
+	n.mufile.Lock()
+	defer n.mufile.Unlock()
+
+	for fileid, filename := range n.replicaTable {
+		if !betweenRight(fileid, predID, n.id()) {
+			continue
+		}
+
+		if ts, ok := n.tombstones[fileid]; ok && ts.Name == filename {
+			log.Printf("dropping replica (%v) of key (%v) deleted at %v", filename, fileid, ts.Deleted)
+			if err := n.store.Delete(filename); err != nil && !os.IsNotExist(err) {
+				log.Println(err)
+				continue
+			}
+			n.usage.removed(filename)
+			delete(n.replicaTable, fileid)
+			continue
+		}
+
+		log.Printf("promoting replica (%v) of key (%v)", filename, fileid)
+		delete(n.replicaTable, fileid)
+		n.fileTable[fileid] = filename
+		n.replicatedTo = nil
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,1047 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"math/big"
+	"math/rand"
+	"net"
+	"net/rpc"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// SimNet is an in-process network of nodes. Calls are dispatched straight
+// to the registered *Node, with arguments and replies passed through gob as
+// net/rpc would. Latency, dropped messages, partitions and crashes can be
+// injected; random decisions come from a seeded source so runs repeat.
+type SimNet struct {
+	mu        sync.Mutex
+	nodes     map[string]*Node
+	rand      *rand.Rand
+	latency   time.Duration
+	jitter    time.Duration
+	dropRate  float64
+	partition map[string]int
+	calls     int
+}
+
+func NewSimNet(seed int64) *SimNet {
+	return &SimNet{
+		nodes:     make(map[string]*Node),
+		rand:      rand.New(rand.NewSource(seed)),
+		partition: make(map[string]int),
+	}
+}
+
+// simCaller is the Caller a single node uses on a SimNet. It knows where the
+// calls come from so that partitions can be applied.
+type simCaller struct {
+	net  *SimNet
+	from string
+}
+
+// Caller returns the Caller to use for calls made by from.
+func (s *SimNet) Caller(from string) Caller {
+	return simCaller{net: s, from: from}
+}
+
+// Add creates a node on the network. Its files are kept in memory.
+func (s *SimNet) Add(addr string, cfg Config) *Node {
+	cfg.Caller = s.Caller(addr)
+	if cfg.Store == nil {
+		cfg.Store = NewMemStore()
+	}
+	if cfg.CallTimeout == 0 {
+		cfg.CallTimeout = 100 * time.Millisecond
+	}
+
+	n := NewNode(addr, cfg)
+
+	s.mu.Lock()
+	s.nodes[addr] = n
+	s.mu.Unlock()
+
+	return n
+}
+
+// Crash removes a node from the network without telling anyone.
+func (s *SimNet) Crash(addr string) {
+	s.mu.Lock()
+	delete(s.nodes, addr)
+	s.mu.Unlock()
+}
+
+// SetLatency delays every call by base plus a random amount up to jitter.
+func (s *SimNet) SetLatency(base, jitter time.Duration) {
+	s.mu.Lock()
+	s.latency, s.jitter = base, jitter
+	s.mu.Unlock()
+}
+
+// SetDropRate makes a fraction of the calls go unanswered until they time
+// out.
+func (s *SimNet) SetDropRate(rate float64) {
+	s.mu.Lock()
+	s.dropRate = rate
+	s.mu.Unlock()
+}
+
+// Partition splits the network: nodes of different groups cannot reach each
+// other. Nodes not listed form a group of their own.
+func (s *SimNet) Partition(groups ...[]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.partition = make(map[string]int)
+	for i, group := range groups {
+		for _, addr := range group {
+			s.partition[addr] = i + 1
+		}
+	}
+}
+
+// Heal removes all partitions.
+func (s *SimNet) Heal() {
+	s.Partition()
+}
+
+// Calls returns how many calls were made so far.
+func (s *SimNet) Calls() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.calls
+}
+
+// Nodes returns the live nodes sorted by ID.
+func (s *SimNet) Nodes() []*Node {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	nodes := make([]*Node, 0, len(s.nodes))
+	for _, n := range s.nodes {
+		nodes = append(nodes, n)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].id().Cmp(nodes[j].id()) < 0 })
+
+	return nodes
+}
+
+// Stabilize runs rounds of every maintenance task on every live node, in
+// ID order. Each round refreshes the whole finger table and ends once the
+// handoffs it started are done.
+func (s *SimNet) Stabilize(rounds int) {
+	ctx := context.Background()
+	for i := 0; i < rounds; i++ {
+		for _, n := range s.Nodes() {
+			n.heartbeat(ctx, n.caller)
+			n.checkPred(ctx, n.caller)
+			n.stabilizeSucc(ctx, n.caller)
+			for range n.fingers() {
+				n.fixFingers(ctx, n.caller)
+			}
+			n.checkReplicas(ctx, n.caller)
+			n.handOffStray()
+		}
+		for _, n := range s.Nodes() {
+			n.handoffs.Wait()
+		}
+	}
+}
+
+func (sc simCaller) Call(addr, proc string, args interface{}, reply interface{}) error {
+	return sc.CallContext(context.Background(), addr, proc, args, reply)
+}
+
+func (sc simCaller) CallContext(ctx context.Context, addr, proc string, args interface{}, reply interface{}) error {
+	s := sc.net
+
+	s.mu.Lock()
+	s.calls++
+	n, ok := s.nodes[addr]
+	reachable := s.partition[sc.from] == s.partition[addr]
+	dropped := s.rand.Float64() < s.dropRate
+	delay := s.latency
+	if s.jitter > 0 {
+		delay += time.Duration(s.rand.Int63n(int64(s.jitter)))
+	}
+	s.mu.Unlock()
+
+	if !ok || !reachable {
+		return &net.OpError{Op: "dial", Net: "sim", Err: fmt.Errorf("no route from (%v) to (%v)", sc.from, addr)}
+	}
+
+	timeout := func() error {
+		return fmt.Errorf("%w: %v on %v", ErrTimeout, proc, addr)
+	}
+
+	if dropped {
+		<-ctx.Done()
+		return timeout()
+	}
+
+	select {
+	case <-time.After(delay):
+	case <-ctx.Done():
+		return timeout()
+	}
+
+	done := make(chan struct{})
+	var out interface{}
+	var err error
+	go func() {
+		out, err = simDispatch(n, proc, args)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return timeout()
+	}
+
+	if err != nil {
+		return decodeError(err)
+	}
+
+	return roundTrip(out, reply)
+}
+
+// simDispatch calls the RPC method proc of n the way net/rpc would and returns
+// its reply.
+func simDispatch(n *Node, proc string, args interface{}) (interface{}, error) {
+	m := reflect.ValueOf(n).MethodByName(proc)
+	if !m.IsValid() || m.Type().NumIn() != 2 || m.Type().NumOut() != 1 || m.Type().In(1).Kind() != reflect.Ptr {
+		return nil, rpc.ServerError("rpc: can't find method Node." + proc)
+	}
+
+	in := reflect.New(m.Type().In(0))
+	if err := roundTrip(args, in.Interface()); err != nil {
+		return nil, err
+	}
+
+	out := reflect.New(m.Type().In(1).Elem())
+	if err, _ := m.Call([]reflect.Value{in.Elem(), out})[0].Interface().(error); err != nil {
+		// As with net/rpc, only the message of a failed call gets back.
+		return nil, rpc.ServerError(err.Error())
+	}
+
+	return out.Interface(), nil
+}
+
+// roundTrip copies src into dst through gob.
+func roundTrip(src, dst interface{}) error {
+	var buff bytes.Buffer
+	if err := gob.NewEncoder(&buff).Encode(src); err != nil {
+		return err
+	}
+
+	return gob.NewDecoder(&buff).Decode(dst)
+}
+
+// simRing adds size nodes with distinct IDs to s and wires them into a
+// correct ring, finger tables included.
+func simRing(s *SimNet, size int, cfg Config) []*Node {
+	ids := make(map[Key]bool)
+	for i := 0; len(ids) < size; i++ {
+		addr := fmt.Sprintf("10.1.%d.%d:8080", i/256, i%256)
+		if id := HashKey(addr, defaultBits); !ids[id] {
+			ids[id] = true
+			s.Add(addr, cfg)
+		}
+	}
+
+	nodes := s.Nodes()
+	for i, n := range nodes {
+		n.setPred(nodes[(i+size-1)%size].Addr)
+
+		var succs []string
+		for j := 1; j <= n.succListLen; j++ {
+			succs = append(succs, nodes[(i+j)%size].Addr)
+		}
+		n.updateSuccList(succs[0], succs[1:])
+
+		for f := range n.fingers() {
+			n.setFinger(f, trueSucc(nodes, n.id().fingerStart(uint(f), n.bits)))
+		}
+	}
+
+	return nodes
+}
+
+// checkRing crawls the ring from start and fails unless it holds exactly
+// the live nodes of s, in order, with consistent pointers.
+func checkRing(t *testing.T, s *SimNet, start string) {
+	t.Helper()
+
+	cr, err := Crawl(context.Background(), s.Caller("crawler"), start, 1<<16, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nodes := s.Nodes()
+	if !cr.Complete || len(cr.Issues) != 0 || len(cr.Nodes) != len(nodes) {
+		t.Fatalf("Expected a consistent ring of (%v) nodes, found (%v) nodes, complete (%v), issues (%v)", len(nodes), len(cr.Nodes), cr.Complete, cr.Issues)
+	}
+}
+
+func TestSimNetLookup(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	for _, mode := range []string{LookupRecursive, LookupIterative} {
+		s := NewSimNet(1)
+		nodes := simRing(s, 300, Config{LookupMode: mode})
+		r := rand.New(rand.NewSource(2))
+
+		for i := 0; i < 200; i++ {
+			id := KeyFromInt(bigRand(r, defaultBits), defaultBits)
+			n := nodes[r.Intn(len(nodes))]
+
+			lr := n.find(context.Background(), id, n.caller)
+			if expected := trueSucc(nodes, id); lr.Addr != expected {
+				t.Fatalf("%v lookup of (%v) from (%v): Expected (%v), found (%v)", mode, id, n.Addr, expected, lr.Addr)
+			}
+		}
+	}
+}
+
+func TestSimNetCrashes(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	s := NewSimNet(3)
+	nodes := simRing(s, 100, Config{})
+
+	// Crash every tenth node, never two neighbours.
+	for i := 0; i < len(nodes); i += 10 {
+		s.Crash(nodes[i].Addr)
+	}
+
+	s.Stabilize(2)
+	checkRing(t, s, nodes[1].Addr)
+
+	alive := s.Nodes()
+	r := rand.New(rand.NewSource(4))
+	for i := 0; i < 100; i++ {
+		id := KeyFromInt(bigRand(r, defaultBits), defaultBits)
+		n := alive[r.Intn(len(alive))]
+
+		if lr := n.find(context.Background(), id, n.caller); lr.Addr != trueSucc(alive, id) {
+			t.Fatalf("lookup of (%v): Expected (%v), found (%v)", id, trueSucc(alive, id), lr.Addr)
+		}
+	}
+}
+
+// TestSimNetFailureDetector crashes the successor and a finger of a node
+// and expects its heartbeats to purge both once they missed enough
+// round trips, announcing each of them.
+func TestSimNetFailureDetector(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	s := NewSimNet(10)
+	nodes := simRing(s, 64, Config{FailAfter: 2})
+	n := nodes[0]
+	ctx := context.Background()
+
+	fingers := n.fingers()
+	succ, finger := n.getSucc(), fingers[len(fingers)-1]
+	n.heartbeat(ctx, n.caller)
+
+	events, cancel := n.detector.subscribe()
+	defer cancel()
+
+	s.Crash(succ)
+	s.Crash(finger)
+
+	n.heartbeat(ctx, n.caller)
+	if !contains(n.fingers(), finger) || n.getSucc() != succ {
+		t.Fatalf("Expected no peer to be purged after one missed heartbeat")
+	}
+
+	n.heartbeat(ctx, n.caller)
+	if contains(n.fingers(), finger) || contains(n.getSuccList(), succ) {
+		t.Errorf("Expected (%v) and (%v) to be purged, found successors (%v) and fingers (%v)", succ, finger, n.getSuccList(), n.fingers())
+	}
+
+	dead := make(map[string]bool)
+	for len(events) > 0 {
+		if ev := <-events; ev.State == PeerDead {
+			dead[ev.Addr] = true
+		}
+	}
+	if !dead[succ] || !dead[finger] {
+		t.Errorf("Expected (%v) and (%v) to be announced dead, found (%v)", succ, finger, dead)
+	}
+
+	s.Stabilize(2)
+	checkRing(t, s, n.Addr)
+}
+
+// TestSimNetRedirect sends requests to nodes that are not responsible for
+// the key and expects them to be redirected to the node that is.
+func TestSimNetRedirect(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	s := NewSimNet(11)
+	nodes := simRing(s, 20, Config{})
+	ctx := context.Background()
+	client := s.Caller("client")
+
+	name := "redirected.txt"
+	id := HashKey(name, defaultBits)
+	owner := trueSucc(nodes, id)
+	sum, _ := checksum(bytes.NewReader([]byte(name)))
+
+	var wrong string
+	for _, n := range nodes {
+		if n.Addr != owner {
+			wrong = n.Addr
+			break
+		}
+	}
+
+	uf := UploadFileReq{ID: id, Filename: name, Content: []byte(name), Checksum: sum}
+	err := client.CallContext(ctx, wrong, "UploadFile", uf, &UploadFileResp{})
+	if addr, ok := redirect(err); !ok || addr != owner {
+		t.Fatalf("Expected a redirect to (%v), found (%v)", owner, err)
+	}
+	if _, ok := s.nodes[wrong].files()[id]; ok {
+		t.Errorf("Expected (%v) not to store (%v)", wrong, name)
+	}
+
+	if err := client.CallContext(ctx, owner, "UploadFile", uf, &UploadFileResp{}); err != nil {
+		t.Fatal(err)
+	}
+
+	rf := RetrieveFileReq{ID: id, Filename: name}
+	err = client.CallContext(ctx, wrong, "RetrieveFile", rf, &RetrieveFileResp{})
+	if addr, ok := redirect(err); !ok || addr != owner {
+		t.Errorf("Expected a redirect to (%v), found (%v)", owner, err)
+	}
+
+	// The successors of the owner serve their replicas.
+	rf.Replica = true
+	var rfr RetrieveFileResp
+	if err := client.CallContext(ctx, s.nodes[owner].getSucc(), "RetrieveFile", rf, &rfr); err != nil || string(rfr.Content) != name {
+		t.Errorf("Expected the replica of (%v), found (%s), (%v)", name, rfr.Content, err)
+	}
+}
+
+// TestSimNetFiles stores files through their owners, pages through the
+// ring-wide listing, stats one of them and deletes it with its replicas.
+func TestSimNetFiles(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	s := NewSimNet(12)
+	nodes := simRing(s, 10, Config{})
+	ctx := context.Background()
+	client := s.Caller("client")
+
+	var ids []Key
+	names := make(map[Key]string)
+	for i := 0; i < 30; i++ {
+		name := fmt.Sprintf("file-%d", i)
+		id := HashKey(name, defaultBits)
+		sum, _ := checksum(bytes.NewReader([]byte(name)))
+		uf := UploadFileReq{ID: id, Filename: name, Content: []byte(name), Checksum: sum}
+		if err := client.CallContext(ctx, trueSucc(nodes, id), "UploadFile", uf, &UploadFileResp{}); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+		names[id] = name
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i].Cmp(ids[j]) < 0 })
+
+	var listed []Key
+	lf := ListFilesReq{Limit: 7}
+	for pages := 0; ; pages++ {
+		if pages > len(ids) {
+			t.Fatalf("Expected the listing to end, found (%v) pages", pages)
+		}
+
+		var lfr ListFilesResp
+		if err := client.CallContext(ctx, nodes[3].Addr, "ListFiles", lf, &lfr); err != nil {
+			t.Fatal(err)
+		}
+		if len(lfr.Files) > lf.Limit {
+			t.Errorf("Expected at most (%v) files on a page, found (%v)", lf.Limit, len(lfr.Files))
+		}
+		for _, fs := range lfr.Files {
+			if fs.Node != trueSucc(nodes, fs.ID) {
+				t.Errorf("Expected (%v) to be owned by (%v), found (%v)", fs.Name, trueSucc(nodes, fs.ID), fs.Node)
+			}
+			listed = append(listed, fs.ID)
+		}
+
+		if !lfr.More {
+			break
+		}
+		lf.From = lfr.Next
+	}
+	if !reflect.DeepEqual(listed, ids) {
+		t.Errorf("Expected the files (%v) in key order, found (%v)", ids, listed)
+	}
+
+	id := ids[0]
+	owner := trueSucc(nodes, id)
+	var fs FileStat
+	if err := client.CallContext(ctx, owner, "StatFile", StatFileReq{Filename: names[id], ID: id}, &fs); err != nil {
+		t.Fatal(err)
+	}
+	if fs.Node != owner || fs.Size != int64(len(names[id])) || fs.Stored.IsZero() {
+		t.Errorf("Expected (%v) of size (%v) on (%v), found (%+v)", names[id], len(names[id]), owner, fs)
+	}
+
+	df := DeleteFileReq{Filename: names[id], ID: id}
+	if err := client.CallContext(ctx, owner, "DeleteFile", df, new(string)); err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range nodes {
+		for _, f := range n.status().Files {
+			if f.ID == id {
+				t.Errorf("Expected (%v) to be gone, found it on (%v)", names[id], n.Addr)
+			}
+		}
+	}
+
+	if err := client.CallContext(ctx, owner, "StatFile", StatFileReq{Filename: names[id], ID: id}, &fs); codeOf(err) != CodeNotFound {
+		t.Errorf("Expected (%v) from stat, found (%v)", CodeNotFound, err)
+	}
+	if err := client.CallContext(ctx, owner, "DeleteFile", df, new(string)); codeOf(err) != CodeNotFound {
+		t.Errorf("Expected (%v) from a second delete, found (%v)", CodeNotFound, err)
+	}
+}
+
+// TestSimNetOwners stores the same file name for two owners and the shared
+// namespace, and checks that each one only sees and deletes its own.
+func TestSimNetOwners(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	s := NewSimNet(13)
+	nodes := simRing(s, 5, Config{})
+	ctx := context.Background()
+	client := s.Caller("client")
+
+	const filename = "report.pdf"
+	owners := []string{"alice", "bob", ""}
+	ids := make(map[string]Key)
+	for _, owner := range owners {
+		id := HashKey(fileName(owner, filename), defaultBits)
+		content := []byte("report of " + owner)
+		sum, _ := checksum(bytes.NewReader(content))
+		uf := UploadFileReq{ID: id, Filename: filename, Owner: owner, Content: content, Checksum: sum}
+		if err := client.CallContext(ctx, trueSucc(nodes, id), "UploadFile", uf, &UploadFileResp{}); err != nil {
+			t.Fatal(err)
+		}
+		ids[owner] = id
+	}
+
+	for _, owner := range owners {
+		rf := RetrieveFileReq{ID: ids[owner], Filename: filename, Owner: owner}
+		var rfr RetrieveFileResp
+		if err := client.CallContext(ctx, trueSucc(nodes, ids[owner]), "RetrieveFile", rf, &rfr); err != nil || string(rfr.Content) != "report of "+owner {
+			t.Errorf("Expected the report of (%v), found (%s), (%v)", owner, rfr.Content, err)
+		}
+
+		var lfr ListFilesResp
+		if err := client.CallContext(ctx, nodes[0].Addr, "ListFiles", ListFilesReq{Owner: owner}, &lfr); err != nil {
+			t.Fatal(err)
+		}
+		if len(lfr.Files) != 1 || lfr.Files[0].ID != ids[owner] || lfr.Files[0].Name != filename || lfr.Files[0].Owner != owner {
+			t.Errorf("Expected only the report of (%v) listed, found (%+v)", owner, lfr.Files)
+		}
+	}
+
+	// Bob can neither delete alice's file under her key nor under his name.
+	addr := trueSucc(nodes, ids["alice"])
+	df := DeleteFileReq{ID: ids["alice"], Filename: filename, Owner: "bob"}
+	if err := client.CallContext(ctx, addr, "DeleteFile", df, new(string)); err == nil {
+		t.Errorf("Expected bob's delete of alice's file to fail")
+	}
+	df = DeleteFileReq{ID: ids["alice"], Filename: "../alice/" + filename, Owner: "bob"}
+	if err := client.CallContext(ctx, addr, "DeleteFile", df, new(string)); err == nil {
+		t.Errorf("Expected bob's delete of alice's file to fail")
+	}
+
+	df = DeleteFileReq{ID: ids["bob"], Filename: filename, Owner: "bob"}
+	if err := client.CallContext(ctx, trueSucc(nodes, ids["bob"]), "DeleteFile", df, new(string)); err != nil {
+		t.Fatal(err)
+	}
+	for _, owner := range []string{"alice", ""} {
+		var fs FileStat
+		sf := StatFileReq{ID: ids[owner], Filename: filename, Owner: owner}
+		if err := client.CallContext(ctx, trueSucc(nodes, ids[owner]), "StatFile", sf, &fs); err != nil {
+			t.Errorf("Expected the report of (%v) to survive, found (%v)", owner, err)
+		}
+	}
+}
+
+func TestSimNetJoin(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	s := NewSimNet(5)
+	first := s.Add("10.2.0.0:8080", Config{})
+	for i := 1; i < 16; i++ {
+		n := s.Add(fmt.Sprintf("10.2.0.%d:8080", i), Config{})
+		if err := n.join(context.Background(), first.Addr, n.caller); err != nil {
+			t.Fatal(err)
+		}
+		s.Stabilize(1)
+	}
+
+	checkRing(t, s, first.Addr)
+}
+
+func TestSimNetShareFiles(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	s := NewSimNet(6)
+	nodes := simRing(s, 20, Config{Replicas: 1})
+
+	// Find an address that takes over some keys from an existing node, and
+	// a file that lands among those keys.
+	var joiner *Node
+	var filename string
+	for i := 0; joiner == nil; i++ {
+		addr := fmt.Sprintf("10.3.0.%d:8080", i)
+		succ := trueSucc(nodes, HashKey(addr, defaultBits))
+		for j := 0; j < 1000; j++ {
+			name := fmt.Sprintf("file-%d", j)
+			id := HashKey(name, defaultBits)
+			if trueSucc(nodes, id) == succ && betweenRight(id, HashKey(s.nodes[succ].getPred(), defaultBits), HashKey(addr, defaultBits)) {
+				joiner, filename = s.Add(addr, Config{Replicas: 1}), name
+				break
+			}
+		}
+	}
+
+	owner := s.nodes[trueSucc(nodes, HashKey(filename, defaultBits))]
+	sum, _ := checksum(bytes.NewReader([]byte(filename)))
+	if err := owner.uploadFile(UploadFileReq{ID: owner.hash(filename), Filename: filename, Content: []byte(filename), Checksum: sum}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := joiner.join(context.Background(), nodes[0].Addr, joiner.caller); err != nil {
+		t.Fatal(err)
+	}
+	// The owner hands the range over after answering Notify.
+	owner.handoffs.Wait()
+
+	if _, ok := joiner.files()[joiner.hash(filename)]; !ok {
+		t.Errorf("Expected (%v) to move to (%v), found (%v)", filename, joiner.Addr, joiner.files())
+	}
+	if _, ok := owner.files()[owner.hash(filename)]; ok {
+		t.Errorf("Expected (%v) to leave (%v)", filename, owner.Addr)
+	}
+
+	if err := joiner.leave(context.Background(), joiner.caller); err != nil {
+		t.Fatal(err)
+	}
+	s.Crash(joiner.Addr)
+
+	if _, ok := owner.files()[owner.hash(filename)]; !ok {
+		t.Errorf("Expected (%v) to be handed back to (%v), found (%v)", filename, owner.Addr, owner.files())
+	}
+}
+
+// hasReplica reports whether n holds a replica of the file of key id.
+func hasReplica(n *Node, id Key) bool {
+	n.mufile.Lock()
+	defer n.mufile.Unlock()
+
+	_, ok := n.replicaTable[id]
+	return ok
+}
+
+// TestSimNetReplicas checks that an upload is replicated to the successors
+// of its owner, and that the replica set follows a node joining right after
+// the owner.
+func TestSimNetReplicas(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	s := NewSimNet(15)
+	cfg := Config{Replicas: 3}
+	nodes := simRing(s, 6, cfg)
+	s.Stabilize(1)
+	owner := nodes[2]
+
+	var filename string
+	for i := 0; filename == ""; i++ {
+		name := fmt.Sprintf("file-%d", i)
+		if trueSucc(nodes, HashKey(name, defaultBits)) == owner.Addr {
+			filename = name
+		}
+	}
+	id := owner.hash(filename)
+
+	sum, _ := checksum(bytes.NewReader([]byte(filename)))
+	uf := UploadFileReq{ID: id, Filename: filename, Content: []byte(filename), Checksum: sum}
+	if err := s.Caller("client").Call(owner.Addr, "UploadFile", uf, &UploadFileResp{}); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, n := range nodes {
+		if want := i == 3 || i == 4; hasReplica(n, id) != want {
+			t.Errorf("Expected a replica of (%v) on (%v) to be (%v)", filename, n.Addr, want)
+		}
+	}
+
+	var joiner *Node
+	for i := 0; joiner == nil; i++ {
+		addr := fmt.Sprintf("10.7.0.%d:8080", i)
+		if between(HashKey(addr, defaultBits), owner.id(), nodes[3].id()) {
+			joiner = s.Add(addr, cfg)
+		}
+	}
+	if err := joiner.join(context.Background(), owner.Addr, joiner.caller); err != nil {
+		t.Fatal(err)
+	}
+	s.Stabilize(4)
+
+	if !hasReplica(joiner, id) || !hasReplica(nodes[3], id) {
+		t.Errorf("Expected replicas of (%v) on (%v) and (%v)", filename, joiner.Addr, nodes[3].Addr)
+	}
+	if hasReplica(nodes[4], id) {
+		t.Errorf("Expected (%v) to drop its replica of (%v) once it left the replica set", nodes[4].Addr, filename)
+	}
+}
+
+// TestSimNetTombstones checks that a replica holder that missed a deletion
+// cannot push its copy back in, while a fresh upload is replicated again.
+func TestSimNetTombstones(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	s := NewSimNet(16)
+	nodes := simRing(s, 5, Config{Replicas: 3})
+	s.Stabilize(1)
+	owner := nodes[2]
+	ctx := context.Background()
+	client := s.Caller("client")
+
+	var filename string
+	for i := 0; filename == ""; i++ {
+		name := fmt.Sprintf("file-%d", i)
+		if trueSucc(nodes, HashKey(name, defaultBits)) == owner.Addr {
+			filename = name
+		}
+	}
+	id := owner.hash(filename)
+
+	sum, _ := checksum(bytes.NewReader([]byte(filename)))
+	uf := UploadFileReq{ID: id, Filename: filename, Content: []byte(filename), Checksum: sum}
+	if err := client.Call(owner.Addr, "UploadFile", uf, &UploadFileResp{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// nodes[4] misses the deletion of its replica.
+	s.Partition([]string{"client", owner.Addr, nodes[3].Addr})
+	if err := client.Call(owner.Addr, "DeleteFile", DeleteFileReq{Filename: filename, ID: id}, new(string)); err != nil {
+		t.Fatal(err)
+	}
+	s.Heal()
+
+	if !hasReplica(nodes[4], id) || hasReplica(nodes[3], id) {
+		t.Fatalf("Expected only (%v) to hold a replica of (%v)", nodes[4].Addr, filename)
+	}
+
+	if err := nodes[4].sendFile(ctx, nodes[4].caller, nodes[3].Addr, id, filename, true); err != nil {
+		t.Fatal(err)
+	}
+	if hasReplica(nodes[3], id) {
+		t.Errorf("Expected (%v) to ignore the copy of deleted (%v)", nodes[3].Addr, filename)
+	}
+
+	if err := client.Call(owner.Addr, "UploadFile", uf, &UploadFileResp{}); err != nil {
+		t.Fatal(err)
+	}
+	if !hasReplica(nodes[3], id) {
+		t.Errorf("Expected (%v) to take a replica of (%v) uploaded again", nodes[3].Addr, filename)
+	}
+}
+
+// TestSimNetNotifyHandoff checks that a node answers Notify before it hands
+// the range of its new predecessor over.
+func TestSimNetNotifyHandoff(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	s := NewSimNet(14)
+	cfg := Config{Replicas: 1, CallTimeout: time.Second}
+	a := s.Add("10.6.0.1:8080", cfg)
+	b := s.Add("10.6.0.2:8080", cfg)
+
+	var filename string
+	for i := 0; filename == ""; i++ {
+		name := fmt.Sprintf("file-%d", i)
+		if betweenRight(b.hash(name), b.id(), a.id()) {
+			filename = name
+		}
+	}
+
+	sum, _ := checksum(bytes.NewReader([]byte(filename)))
+	if err := b.uploadFile(UploadFileReq{ID: b.hash(filename), Filename: filename, Content: []byte(filename), Checksum: sum}); err != nil {
+		t.Fatal(err)
+	}
+
+	s.SetLatency(100*time.Millisecond, 0)
+	var empty string
+	if err := a.call(context.Background(), a.caller, b.Addr, "Notify", a.Addr, &empty); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := a.files()[a.hash(filename)]; ok {
+		t.Errorf("Expected Notify to return before (%v) is handed over", filename)
+	}
+
+	b.handoffs.Wait()
+	if _, ok := a.files()[a.hash(filename)]; !ok {
+		t.Errorf("Expected (%v) to move to (%v), found (%v)", filename, a.Addr, a.files())
+	}
+}
+
+func TestSimNetFaults(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	s := NewSimNet(7)
+	a := s.Add("10.4.0.1:8080", Config{})
+	b := s.Add("10.4.0.2:8080", Config{})
+	ctx := context.Background()
+
+	var rr RingResp
+	if err := a.call(ctx, a.caller, b.Addr, "Ring", "", &rr); err != nil || rr.Addr != b.Addr {
+		t.Fatalf("Expected (%v) to answer, found (%v), (%v)", b.Addr, rr.Addr, err)
+	}
+
+	if err := a.call(ctx, a.caller, b.Addr, "NoSuchMethod", "", &rr); err == nil {
+		t.Errorf("Expected an unknown method to fail")
+	}
+
+	s.Partition([]string{a.Addr})
+	if err := a.call(ctx, a.caller, b.Addr, "Ring", "", &rr); !isDialErr(err) {
+		t.Errorf("Expected a partition to look like a dial error, found (%v)", err)
+	}
+	s.Heal()
+
+	s.SetDropRate(1)
+	if err := a.call(ctx, a.caller, b.Addr, "Ring", "", &rr); !errors.Is(err, ErrTimeout) {
+		t.Errorf("Expected a dropped call to time out, found (%v)", err)
+	}
+	s.SetDropRate(0)
+
+	s.SetLatency(50*time.Millisecond, 0)
+	start := time.Now()
+	if err := a.call(ctx, a.caller, b.Addr, "Ring", "", &rr); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("Expected at least (%v) latency, found (%v)", 50*time.Millisecond, elapsed)
+	}
+
+	s.SetLatency(time.Second, 0)
+	if err := a.call(ctx, a.caller, b.Addr, "Ring", "", &rr); !errors.Is(err, ErrTimeout) {
+		t.Errorf("Expected a slow call to time out, found (%v)", err)
+	}
+}
+
+// bigRand returns a random identifier of the given width.
+func bigRand(r *rand.Rand, bits uint) *big.Int {
+	return new(big.Int).Rand(r, new(big.Int).Lsh(big.NewInt(1), bits))
+}
+
+// TestSimNetConcurrentJoinLookup joins nodes while lookups, maintenance and
+// status queries run on the ring. It is most useful under the race
+// detector, see the race target of the Makefile.
+func TestSimNetConcurrentJoinLookup(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	s := NewSimNet(8)
+	cfg := Config{CallTimeout: time.Second}
+	nodes := simRing(s, 30, cfg)
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+
+			r := rand.New(rand.NewSource(seed))
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				n := nodes[r.Intn(len(nodes))]
+				n.find(context.Background(), KeyFromInt(bigRand(r, defaultBits), defaultBits), n.caller)
+				n.status()
+			}
+		}(int64(i))
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				s.Stabilize(1)
+			}
+		}
+	}()
+
+	for i := 0; i < 10; i++ {
+		n := s.Add(fmt.Sprintf("10.5.0.%d:8080", i), cfg)
+		if err := n.join(context.Background(), nodes[i].Addr, n.caller); err != nil {
+			t.Error(err)
+		}
+	}
+
+	close(stop)
+	wg.Wait()
+
+	// Joiners landing next to each other settle one per round.
+	s.Stabilize(8)
+	checkRing(t, s, nodes[0].Addr)
+}
+
+// TestSimNetConcurrentJoins joins many nodes at once, several of them
+// through the same peer and into the same arc, and expects the ring and
+// the placement of files to converge once maintenance has run.
+func TestSimNetConcurrentJoins(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	s := NewSimNet(9)
+	cfg := Config{CallTimeout: time.Second}
+	nodes := simRing(s, 4, cfg)
+
+	var names []string
+	for i := 0; i < 50; i++ {
+		name := fmt.Sprintf("file-%d", i)
+		owner := s.nodes[trueSucc(nodes, HashKey(name, defaultBits))]
+		sum, _ := checksum(bytes.NewReader([]byte(name)))
+		if err := owner.uploadFile(UploadFileReq{ID: owner.hash(name), Filename: name, Content: []byte(name), Checksum: sum}); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 32; i++ {
+		n := s.Add(fmt.Sprintf("10.9.0.%d:8080", i), cfg)
+		wg.Add(1)
+		go func(peer string) {
+			defer wg.Done()
+			if err := n.join(context.Background(), peer, n.caller); err != nil {
+				t.Error(err)
+			}
+		}(nodes[i%2].Addr)
+	}
+	wg.Wait()
+
+	s.Stabilize(32)
+	checkRing(t, s, nodes[0].Addr)
+
+	all := s.Nodes()
+	for _, name := range names {
+		id := HashKey(name, defaultBits)
+		owner := s.nodes[trueSucc(all, id)]
+		if _, ok := owner.files()[id]; !ok {
+			t.Errorf("Expected (%v) on (%v), found (%v)", name, owner.Addr, owner.files())
+		}
+	}
+}
+
+func TestSimNetLeave(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	s := NewSimNet(9)
+	nodes := simRing(s, 10, Config{Replicas: 2})
+	pred, leaver, succ := nodes[3], nodes[4], nodes[5]
+
+	var stored []string
+	for i := 0; len(stored) < 5; i++ {
+		filename := fmt.Sprintf("file-%d", i)
+		if trueSucc(nodes, HashKey(filename, defaultBits)) != leaver.Addr {
+			continue
+		}
+
+		sum, _ := checksum(bytes.NewReader([]byte(filename)))
+		if err := leaver.uploadFile(UploadFileReq{ID: leaver.hash(filename), Filename: filename, Content: []byte(filename), Checksum: sum}); err != nil {
+			t.Fatal(err)
+		}
+		stored = append(stored, filename)
+	}
+
+	if err := leaver.leave(context.Background(), leaver.caller); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-leaver.done():
+	default:
+		t.Errorf("Expected (%v) to shut down after leaving", leaver.Addr)
+	}
+
+	for _, filename := range stored {
+		if _, ok := succ.files()[succ.hash(filename)]; !ok {
+			t.Errorf("Expected (%v) to own (%v), found (%v)", succ.Addr, filename, succ.files())
+		}
+		if _, err := leaver.store.Stat(filename); err == nil {
+			t.Errorf("Expected (%v) to be removed from (%v)", filename, leaver.Addr)
+		}
+	}
+
+	if pred.getSucc() != succ.Addr || succ.getPred() != pred.Addr {
+		t.Errorf("Expected (%v) and (%v) to be neighbours, found successor (%v) and predecessor (%v)", pred.Addr, succ.Addr, pred.getSucc(), succ.getPred())
+	}
+
+	s.Crash(leaver.Addr)
+	checkRing(t, s, pred.Addr)
+}
+
+func TestSimNetLeaveAborts(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	s := NewSimNet(10)
+	nodes := simRing(s, 5, Config{Replicas: 1, CallTimeout: 10 * time.Millisecond})
+	pred, leaver, succ := nodes[1], nodes[2], nodes[3]
+
+	filename := ""
+	for i := 0; filename == ""; i++ {
+		if name := fmt.Sprintf("file-%d", i); trueSucc(nodes, HashKey(name, defaultBits)) == leaver.Addr {
+			filename = name
+		}
+	}
+	sum, _ := checksum(bytes.NewReader([]byte(filename)))
+	if err := leaver.uploadFile(UploadFileReq{ID: leaver.hash(filename), Filename: filename, Content: []byte(filename), Checksum: sum}); err != nil {
+		t.Fatal(err)
+	}
+
+	s.SetDropRate(1)
+	if err := leaver.leave(context.Background(), leaver.caller); err == nil {
+		t.Fatalf("Expected leave to fail while no call gets through")
+	}
+	s.SetDropRate(0)
+
+	if _, ok := leaver.files()[leaver.hash(filename)]; !ok {
+		t.Errorf("Expected (%v) to keep (%v) after an aborted leave", leaver.Addr, filename)
+	}
+	if pred.getSucc() != leaver.Addr || succ.getPred() != leaver.Addr {
+		t.Errorf("Expected neighbours to keep pointing at (%v), found (%v) and (%v)", leaver.Addr, pred.getSucc(), succ.getPred())
+	}
+
+	select {
+	case <-leaver.done():
+		t.Errorf("Expected (%v) to keep running after an aborted leave", leaver.Addr)
+	default:
+	}
+}
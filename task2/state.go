@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// stateFile names the index of a node's files and last known neighbours. It
+// lives in the node's directory so that a restarted node can recover.
+const stateFile = ".state.json"
+
+type nodeState struct {
+	Files       map[Key]string
+	Replicas    map[Key]string
+	Tombstones  map[Key]tombstone
+	Successors  []string
+	Predecessor string
+}
+
+// saveState writes the file tables and neighbours to the state file. The
+// file is replaced atomically so a crash never leaves a torn index behind.
+func (n *Node) saveState() error {
+	n.mufile.Lock()
+	st := nodeState{
+		Files:       make(map[Key]string, len(n.fileTable)),
+		Replicas:    make(map[Key]string, len(n.replicaTable)),
+		Tombstones:  make(map[Key]tombstone, len(n.tombstones)),
+		Successors:  n.getSuccList(),
+		Predecessor: n.getPred(),
+	}
+	for fileid, filename := range n.fileTable {
+		st.Files[fileid] = filename
+	}
+	for fileid, filename := range n.replicaTable {
+		st.Replicas[fileid] = filename
+	}
+	for fileid, ts := range n.tombstones {
+		st.Tombstones[fileid] = ts
+	}
+	n.mufile.Unlock()
+
+	buff, err := json.MarshalIndent(st, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(n.dir(), 0700); err != nil {
+		return err
+	}
+
+	path := filepath.Join(n.dir(), stateFile)
+	if err := ioutil.WriteFile(path+".tmp", buff, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(path+".tmp", path)
+}
+
+// loadState restores the file tables saved by a previous run and reconciles
+// them with the store: entries whose file is gone are dropped, and files
+// missing from the index are adopted, as primaries if they fall into the
+// range of the last known predecessor and as replicas otherwise.
+func (n *Node) loadState() error {
+	var st nodeState
+
+	buff, err := ioutil.ReadFile(filepath.Join(n.dir(), stateFile))
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return err
+	default:
+		if err := json.Unmarshal(buff, &st); err != nil {
+			return fmt.Errorf("reading %v: %v", stateFile, err)
+		}
+	}
+
+	n.mufile.Lock()
+	defer n.mufile.Unlock()
+
+	known := make(map[string]bool)
+	for fileid, filename := range st.Files {
+		if _, err := n.store.Stat(filename); err != nil {
+			log.Printf("dropping file (%v) of key (%v) missing from the store", filename, fileid)
+			continue
+		}
+		n.fileTable[fileid] = filename
+		known[filename] = true
+	}
+	for fileid, filename := range st.Replicas {
+		if _, err := n.store.Stat(filename); err != nil {
+			log.Printf("dropping replica (%v) of key (%v) missing from the store", filename, fileid)
+			continue
+		}
+		n.replicaTable[fileid] = filename
+		known[filename] = true
+	}
+
+	for fileid, ts := range st.Tombstones {
+		n.tombstones[fileid] = ts
+	}
+
+	pred := st.Predecessor
+	if pred == "" {
+		pred = n.Addr
+	}
+
+	infos, err := n.store.List()
+	for _, fi := range infos {
+		n.usage.stored(fi.Name, fi.Size)
+		if known[fi.Name] {
+			continue
+		}
+
+		fileid := n.hash(fi.Name)
+		if betweenRight(fileid, n.hash(pred), n.id()) {
+			n.fileTable[fileid] = fi.Name
+		} else {
+			n.replicaTable[fileid] = fi.Name
+		}
+		log.Printf("adopting file (%v) of key (%v) found in the store", fi.Name, fileid)
+	}
+
+	n.lastKnown = append(st.Successors, st.Predecessor)
+
+	return err
+}
+
+// rejoin joins the ring again through the neighbours known before a
+// restart, trying them in order.
+func (n *Node) rejoin(ctx context.Context, caller Caller) error {
+	var err error
+	for _, addr := range n.lastKnown {
+		if addr == "" || addr == n.Addr {
+			continue
+		}
+
+		if err = n.join(ctx, addr, caller); err == nil {
+			return nil
+		}
+		log.Printf("rejoining through (%v): %v", addr, err)
+	}
+
+	return err
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestNodeStateRecovery(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	n := NewNode("localhost:8080", Config{})
+	n.setSucc("localhost:8081")
+
+	for _, filename := range []string{"kept", "lost"} {
+		if err := ioutil.WriteFile(filename, []byte(filename), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := pushFile(directCall(n, map[string]int{}), filename, UploadFileReq{ID: n.hash(filename), Filename: filename}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Only set the predecessor now, so that the uploads are accepted
+	// whatever their keys.
+	n.setPred("localhost:8079")
+	if err := n.saveState(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Lose one file behind the node's back and drop in one it never saw.
+	if err := n.store.Delete("lost"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(n.dir(), "stray"), []byte("stray"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewNode("localhost:8080", Config{})
+
+	if _, ok := r.fileTable[n.hash("kept")]; !ok {
+		t.Errorf("Expected (kept) to be recovered, found (%v)", r.fileTable)
+	}
+	if _, ok := r.fileTable[n.hash("lost")]; ok {
+		t.Errorf("Expected (lost) to be dropped, found (%v)", r.fileTable)
+	}
+
+	// With the saved predecessor below us, the stray file belongs to us
+	// unless its key falls outside (pred, self].
+	stray := n.hash("stray")
+	table := r.replicaTable
+	if betweenRight(stray, n.hash("localhost:8079"), n.id()) {
+		table = r.fileTable
+	}
+	if table[stray] != "stray" {
+		t.Errorf("Expected (stray) to be adopted, found (%v) and (%v)", r.fileTable, r.replicaTable)
+	}
+	if r.checksum("stray") == "" {
+		t.Errorf("Expected a checksum for (stray), found none")
+	}
+
+	expected := []string{"localhost:8081", "localhost:8079"}
+	if !reflect.DeepEqual(r.lastKnown, expected) {
+		t.Errorf("Expected last known peers (%v), found (%v)", expected, r.lastKnown)
+	}
+
+	if _, err := os.Stat(filepath.Join(n.dir(), stateFile)); err != nil {
+		t.Errorf("Expected a state file, found (%v)", err)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+// NodeStatus describes the routing state and the files of a node.
+type NodeStatus struct {
+	Addr        string
+	ID          Key
+	Bits        uint
+	Predecessor string
+	Successors  []string
+	Fingers     []Finger
+	Files       []FileStatus
+}
+
+type Finger struct {
+	// Start is the first identifier the finger is responsible for.
+	Start Key
+	Addr  string
+	ID    Key
+}
+
+type FileStatus struct {
+	ID       Key
+	Name     string
+	Size     int64
+	Checksum string
+	Replica  bool
+}
+
+func (n *Node) status() NodeStatus {
+	ns := NodeStatus{
+		Addr:        n.Addr,
+		ID:          n.id(),
+		Bits:        n.bits,
+		Predecessor: n.getPred(),
+		Successors:  n.getSuccList(),
+	}
+
+	for i, addr := range n.fingers() {
+		ns.Fingers = append(ns.Fingers, Finger{Start: n.id().fingerStart(uint(i), n.bits), Addr: addr, ID: n.hash(addr)})
+	}
+
+	n.mufile.Lock()
+	tables := []map[Key]string{n.fileTable, n.replicaTable}
+	for i, table := range tables {
+		for fileid, filename := range table {
+			fs := FileStatus{ID: fileid, Name: filename, Replica: i == 1}
+			if fi, err := n.store.Stat(filename); err == nil {
+				fs.Size = fi.Size
+				fs.Checksum = fi.Checksum
+			}
+			ns.Files = append(ns.Files, fs)
+		}
+	}
+	n.mufile.Unlock()
+
+	sort.Slice(ns.Files, func(i, j int) bool { return ns.Files[i].ID.Cmp(ns.Files[j].ID) < 0 })
+
+	return ns
+}
+
+func (n *Node) Status(_ string, ns *NodeStatus) error {
+	*ns = n.status()
+	return nil
+}
+
+// printStatus writes ns in the layout of the interactive menu.
+func printStatus(w io.Writer, ns NodeStatus) {
+	fmt.Fprintf(w, "Address (%v) ID (%v) in a ring of %d bits\n", ns.Addr, ns.ID, ns.Bits)
+	fmt.Fprintf(w, "Predecessor (%v)\n", ns.Predecessor)
+	for i, succ := range ns.Successors {
+		fmt.Fprintf(w, "Successor %d (%v)\n", i+1, succ)
+	}
+
+	fmt.Fprintln(w, "i   | address        | ID")
+	for i, f := range ns.Fingers {
+		fmt.Fprintf(w, "%03d (%7v) | %v | %7v\n", i, f.Start, f.Addr, f.ID)
+	}
+
+	fmt.Fprintln(w, "Key     | Filename")
+	for _, f := range ns.Files {
+		replica := ""
+		if f.Replica {
+			replica = " (replica)"
+		}
+		fmt.Fprintf(w, "(%7v) | %v%v, %d bytes\n", f.ID, f.Name, replica, f.Size)
+	}
+}
@@ -0,0 +1,572 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Store keeps the content of the files a node holds. Implementations must be
+// safe for concurrent use.
+type Store interface {
+	// Put stores everything read from r under name, replacing any previous
+	// content. The content must hash to checksum (hex SHA-256), otherwise
+	// nothing is stored and an error wrapping ErrChecksumMismatch is
+	// returned.
+	Put(name string, r io.Reader, checksum string) (FileInfo, error)
+	// Get opens the content stored under name. The caller closes it.
+	Get(name string) (io.ReadSeekCloser, FileInfo, error)
+	Delete(name string) error
+	// List returns every stored file, sorted by name.
+	List() ([]FileInfo, error)
+	Stat(name string) (FileInfo, error)
+}
+
+// Adopter is implemented by stores that can take over a local file, such as
+// a completely received upload, without copying it.
+type Adopter interface {
+	// Adopt moves the file at path into the store under name, once it is
+	// verified against checksum. The file stays at path on failure.
+	Adopt(name, path, checksum string) (FileInfo, error)
+}
+
+type FileInfo struct {
+	Name     string
+	Size     int64
+	Checksum string
+	ModTime  time.Time
+}
+
+const (
+	StoreFS   = "fs"
+	StoreMem  = "mem"
+	StoreCAS  = "cas"
+	storeTemp = ".tmp-"
+)
+
+// NewStore returns a store of the given kind keeping its data under dir.
+func NewStore(kind, dir string) (Store, error) {
+	switch kind {
+	case StoreFS:
+		return NewFSStore(dir), nil
+	case StoreMem:
+		return NewMemStore(), nil
+	case StoreCAS:
+		return NewCASStore(dir)
+	}
+
+	return nil, fmt.Errorf("unknown store (%v)", kind)
+}
+
+// writeVerified copies r to a new temporary file in dir and checks the copy
+// against checksum. The caller moves the file into place or removes it.
+func writeVerified(dir string, r io.Reader, checksum string) (string, int64, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", 0, err
+	}
+
+	f, err := ioutil.TempFile(dir, storeTemp)
+	if err != nil {
+		return "", 0, err
+	}
+
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(f, h), r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", 0, err
+	}
+
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != checksum {
+		os.Remove(f.Name())
+		return "", 0, fmt.Errorf("%w: content has checksum (%v), expected (%v)", ErrChecksumMismatch, sum, checksum)
+	}
+
+	return f.Name(), size, nil
+}
+
+// FSStore keeps every file under its name below a directory, with its
+// checksum in a sidecar file next to it. Top-level names starting with a
+// dot are reserved for the node's own bookkeeping, and names ending in
+// checksumSuffix for the sidecars.
+type FSStore struct {
+	dir string
+	mu  sync.Mutex
+}
+
+func NewFSStore(dir string) *FSStore {
+	return &FSStore{dir: dir}
+}
+
+func (s *FSStore) path(name string) (string, error) {
+	name = filepath.Clean(name)
+	if filepath.IsAbs(name) || name == "." || strings.HasPrefix(name, ".") || strings.HasSuffix(name, checksumSuffix) {
+		return "", fmt.Errorf("invalid file name (%v)", name)
+	}
+
+	return filepath.Join(s.dir, name), nil
+}
+
+func (s *FSStore) Put(name string, r io.Reader, checksum string) (FileInfo, error) {
+	path, err := s.path(name)
+	if err != nil {
+		return FileInfo{}, err
+	}
+
+	tmp, _, err := writeVerified(s.dir, r, checksum)
+	if err != nil {
+		return FileInfo{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		os.Remove(tmp)
+		return FileInfo{}, err
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return FileInfo{}, err
+	}
+
+	if err := ioutil.WriteFile(path+checksumSuffix, []byte(checksum+"\n"), 0644); err != nil {
+		return FileInfo{}, err
+	}
+
+	return s.stat(name, path)
+}
+
+// Adopt verifies the file at path and renames it into place. path must be
+// on the same file system as the store.
+func (s *FSStore) Adopt(name, path, sum string) (FileInfo, error) {
+	dst, err := s.path(name)
+	if err != nil {
+		return FileInfo{}, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	got, err := checksum(f)
+	f.Close()
+	if err != nil {
+		return FileInfo{}, err
+	}
+	if got != sum {
+		return FileInfo{}, fmt.Errorf("%w: content has checksum (%v), expected (%v)", ErrChecksumMismatch, got, sum)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+		return FileInfo{}, err
+	}
+
+	if err := os.Rename(path, dst); err != nil {
+		return FileInfo{}, err
+	}
+
+	if err := ioutil.WriteFile(dst+checksumSuffix, []byte(sum+"\n"), 0644); err != nil {
+		return FileInfo{}, err
+	}
+
+	return s.stat(name, dst)
+}
+
+func (s *FSStore) Get(name string) (io.ReadSeekCloser, FileInfo, error) {
+	path, err := s.path(name)
+	if err != nil {
+		return nil, FileInfo{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fi, err := s.stat(name, path)
+	if err != nil {
+		return nil, FileInfo{}, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, FileInfo{}, err
+	}
+
+	return f, fi, nil
+}
+
+func (s *FSStore) Delete(name string) error {
+	path, err := s.path(name)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := os.Remove(path + checksumSuffix); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return os.Remove(path)
+}
+
+func (s *FSStore) Stat(name string) (FileInfo, error) {
+	path, err := s.path(name)
+	if err != nil {
+		return FileInfo{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.stat(name, path)
+}
+
+// stat describes the file at path. A missing checksum sidecar, as left by
+// files copied into the directory by hand, is computed and written.
+func (s *FSStore) stat(name, path string) (FileInfo, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	if fi.IsDir() {
+		return FileInfo{}, fmt.Errorf("(%v) is a directory", name)
+	}
+
+	info := FileInfo{Name: filepath.ToSlash(filepath.Clean(name)), Size: fi.Size(), ModTime: fi.ModTime()}
+
+	sum, err := ioutil.ReadFile(path + checksumSuffix)
+	if err == nil {
+		info.Checksum = strings.TrimSpace(string(sum))
+		return info, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	defer f.Close()
+
+	if info.Checksum, err = checksum(f); err != nil {
+		return FileInfo{}, err
+	}
+
+	return info, ioutil.WriteFile(path+checksumSuffix, []byte(info.Checksum+"\n"), 0644)
+}
+
+func (s *FSStore) List() ([]FileInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var infos []FileInfo
+	err := filepath.WalkDir(s.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		name, err := filepath.Rel(s.dir, path)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case name == ".":
+			return nil
+		case d.IsDir() && strings.HasPrefix(name, "."):
+			return filepath.SkipDir
+		case d.IsDir(), strings.HasPrefix(name, "."), strings.HasSuffix(name, checksumSuffix):
+			return nil
+		}
+
+		info, err := s.stat(name, path)
+		if err != nil {
+			return err
+		}
+
+		infos = append(infos, info)
+		return nil
+	})
+	if os.IsNotExist(err) {
+		err = nil
+	}
+
+	return infos, err
+}
+
+// MemStore keeps files in memory. It is meant for tests and throwaway nodes.
+type MemStore struct {
+	mu    sync.Mutex
+	files map[string]memFile
+}
+
+type memFile struct {
+	data []byte
+	info FileInfo
+}
+
+// memReader serves a snapshot of a MemStore file.
+type memReader struct {
+	*bytes.Reader
+}
+
+func (memReader) Close() error { return nil }
+
+func NewMemStore() *MemStore {
+	return &MemStore{files: make(map[string]memFile)}
+}
+
+func (s *MemStore) Put(name string, r io.Reader, checksum string) (FileInfo, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return FileInfo{}, err
+	}
+
+	sum := sha256.Sum256(data)
+	if hex.EncodeToString(sum[:]) != checksum {
+		return FileInfo{}, fmt.Errorf("%w: content has checksum (%v), expected (%v)", ErrChecksumMismatch, hex.EncodeToString(sum[:]), checksum)
+	}
+
+	info := FileInfo{Name: name, Size: int64(len(data)), Checksum: checksum, ModTime: time.Now()}
+
+	s.mu.Lock()
+	s.files[name] = memFile{data: data, info: info}
+	s.mu.Unlock()
+
+	return info, nil
+}
+
+func (s *MemStore) Get(name string) (io.ReadSeekCloser, FileInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, ok := s.files[name]
+	if !ok {
+		return nil, FileInfo{}, notExist(name)
+	}
+
+	// Put never modifies data in place, so readers can share it.
+	return memReader{bytes.NewReader(f.data)}, f.info, nil
+}
+
+func (s *MemStore) Delete(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.files[name]; !ok {
+		return notExist(name)
+	}
+
+	delete(s.files, name)
+	return nil
+}
+
+func (s *MemStore) Stat(name string) (FileInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, ok := s.files[name]
+	if !ok {
+		return FileInfo{}, notExist(name)
+	}
+
+	return f.info, nil
+}
+
+func (s *MemStore) List() ([]FileInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	infos := make([]FileInfo, 0, len(s.files))
+	for _, f := range s.files {
+		infos = append(infos, f.info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+
+	return infos, nil
+}
+
+// CASStore keeps every distinct content once, in an object named after its
+// checksum, and maps file names to objects through an index. Files with the
+// same content share an object, which is removed with its last name.
+type CASStore struct {
+	dir   string
+	mu    sync.Mutex
+	index map[string]FileInfo
+}
+
+const (
+	casObjects = ".objects"
+	casIndex   = ".index.json"
+)
+
+// NewCASStore opens the content-addressed store under dir, loading its
+// index if there is one.
+func NewCASStore(dir string) (*CASStore, error) {
+	s := &CASStore{dir: dir, index: make(map[string]FileInfo)}
+
+	buff, err := ioutil.ReadFile(filepath.Join(dir, casIndex))
+	switch {
+	case os.IsNotExist(err):
+		return s, nil
+	case err != nil:
+		return nil, err
+	}
+
+	if err := json.Unmarshal(buff, &s.index); err != nil {
+		return nil, fmt.Errorf("reading %v: %v", casIndex, err)
+	}
+
+	return s, nil
+}
+
+func (s *CASStore) object(checksum string) string {
+	return filepath.Join(s.dir, casObjects, checksum)
+}
+
+// saveIndex replaces the index file atomically. The caller holds s.mu.
+func (s *CASStore) saveIndex() error {
+	buff, err := json.MarshalIndent(s.index, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(s.dir, casIndex)
+	if err := ioutil.WriteFile(path+".tmp", buff, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(path+".tmp", path)
+}
+
+// release removes the object of checksum unless some file still refers to
+// it. The caller holds s.mu.
+func (s *CASStore) release(checksum string) error {
+	for _, info := range s.index {
+		if info.Checksum == checksum {
+			return nil
+		}
+	}
+
+	if err := os.Remove(s.object(checksum)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+func (s *CASStore) Put(name string, r io.Reader, checksum string) (FileInfo, error) {
+	tmp, size, err := writeVerified(filepath.Join(s.dir, casObjects), r, checksum)
+	if err != nil {
+		return FileInfo{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	obj := s.object(checksum)
+	if _, err := os.Stat(obj); err == nil {
+		// Deduplicated: the content is already stored.
+		os.Remove(tmp)
+	} else if err := os.Rename(tmp, obj); err != nil {
+		os.Remove(tmp)
+		return FileInfo{}, err
+	}
+
+	old, replaced := s.index[name]
+	info := FileInfo{Name: name, Size: size, Checksum: checksum, ModTime: time.Now()}
+	s.index[name] = info
+	if err := s.saveIndex(); err != nil {
+		return FileInfo{}, err
+	}
+
+	if replaced && old.Checksum != checksum {
+		if err := s.release(old.Checksum); err != nil {
+			return FileInfo{}, err
+		}
+	}
+
+	return info, nil
+}
+
+func (s *CASStore) Get(name string) (io.ReadSeekCloser, FileInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	info, ok := s.index[name]
+	if !ok {
+		return nil, FileInfo{}, notExist(name)
+	}
+
+	f, err := os.Open(s.object(info.Checksum))
+	if err != nil {
+		return nil, FileInfo{}, err
+	}
+
+	return f, info, nil
+}
+
+func (s *CASStore) Delete(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	info, ok := s.index[name]
+	if !ok {
+		return notExist(name)
+	}
+
+	delete(s.index, name)
+	if err := s.saveIndex(); err != nil {
+		return err
+	}
+
+	return s.release(info.Checksum)
+}
+
+func (s *CASStore) Stat(name string) (FileInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	info, ok := s.index[name]
+	if !ok {
+		return FileInfo{}, notExist(name)
+	}
+
+	return info, nil
+}
+
+func (s *CASStore) List() ([]FileInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	infos := make([]FileInfo, 0, len(s.index))
+	for _, info := range s.index {
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+
+	return infos, nil
+}
+
+// notExist returns an error for a missing file that os.IsNotExist reports.
+func notExist(name string) error {
+	return &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+}
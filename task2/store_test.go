@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStores(t *testing.T) {
+	for _, kind := range []string{StoreFS, StoreMem, StoreCAS} {
+		t.Run(kind, func(t *testing.T) {
+			s, err := NewStore(kind, t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			sum, _ := checksum(bytes.NewReader([]byte("hello")))
+			if _, err := s.Put("a.txt", bytes.NewReader([]byte("hellO")), sum); !errors.Is(err, ErrChecksumMismatch) {
+				t.Errorf("Expected a checksum mismatch, found (%v)", err)
+			}
+			if _, err := s.Stat("a.txt"); !os.IsNotExist(err) {
+				t.Errorf("Expected a corrupted put to store nothing, found (%v)", err)
+			}
+
+			for _, name := range []string{"b.txt", "a.txt"} {
+				if _, err := s.Put(name, bytes.NewReader([]byte("hello")), sum); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			f, fi, err := s.Get("a.txt")
+			if err != nil {
+				t.Fatal(err)
+			}
+			content, err := ioutil.ReadAll(f)
+			f.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(content) != "hello" || fi.Size != 5 || fi.Checksum != sum {
+				t.Errorf("Expected (hello) of size (5) and checksum (%v), found (%s) of size (%v) and checksum (%v)", sum, content, fi.Size, fi.Checksum)
+			}
+
+			infos, err := s.List()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(infos) != 2 || infos[0].Name != "a.txt" || infos[1].Name != "b.txt" {
+				t.Errorf("Expected (a.txt) and (b.txt) to be listed, found (%v)", infos)
+			}
+
+			if err := s.Delete("a.txt"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := s.Stat("a.txt"); !os.IsNotExist(err) {
+				t.Errorf("Expected (a.txt) to be deleted, found (%v)", err)
+			}
+			if _, err := s.Stat("b.txt"); err != nil {
+				t.Errorf("Expected (b.txt) to survive, found (%v)", err)
+			}
+		})
+	}
+}
+
+func TestCASStoreDedup(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewCASStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sum, _ := checksum(bytes.NewReader([]byte("hello")))
+	for _, name := range []string{"a.txt", "b.txt"} {
+		if _, err := s.Put(name, bytes.NewReader([]byte("hello")), sum); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	objects := func() int {
+		entries, err := ioutil.ReadDir(filepath.Join(dir, casObjects))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(entries)
+	}
+
+	if objects() != 1 {
+		t.Errorf("Expected (1) object for identical content, found (%v)", objects())
+	}
+
+	if err := s.Delete("a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if objects() != 1 {
+		t.Errorf("Expected the shared object to survive, found (%v) objects", objects())
+	}
+
+	// The index survives a reopen.
+	if s, err = NewCASStore(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete("b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if objects() != 0 {
+		t.Errorf("Expected the object to go with its last name, found (%v) objects", objects())
+	}
+}
+
+func TestFSStoreAdopt(t *testing.T) {
+	dir := t.TempDir()
+	s := NewFSStore(dir)
+
+	path := filepath.Join(dir, ".incoming", "upload")
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	sum, _ := checksum(bytes.NewReader([]byte("hello")))
+	bad, _ := checksum(bytes.NewReader([]byte("hellO")))
+	if _, err := s.Adopt("a.txt", path, bad); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("Expected a checksum mismatch, found (%v)", err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("Expected a corrupted file to stay in place, found (%v)", err)
+	}
+
+	fi, err := s.Adopt("docs/a.txt", path, sum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Name != "docs/a.txt" || fi.Size != 5 || fi.Checksum != sum {
+		t.Errorf("Expected (docs/a.txt) of size (5) and checksum (%v), found (%+v)", sum, fi)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Expected the adopted file to be moved, found (%v)", err)
+	}
+	if fi, err := s.Stat("docs/a.txt"); err != nil || fi.Checksum != sum {
+		t.Errorf("Expected (docs/a.txt) with checksum (%v), found (%+v), (%v)", sum, fi, err)
+	}
+}
+
+func TestFSStoreReservedNames(t *testing.T) {
+	s := NewFSStore(t.TempDir())
+
+	sum, _ := checksum(bytes.NewReader([]byte("hello")))
+	if _, err := s.Put("x", bytes.NewReader([]byte("hello")), sum); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"x" + checksumSuffix, ".x", "../x", "/x", "."} {
+		if _, err := s.Put(name, bytes.NewReader([]byte("hello")), sum); err == nil {
+			t.Errorf("Expected (%v) to be refused", name)
+		}
+	}
+
+	if fi, err := s.Stat("x"); err != nil || fi.Checksum != sum {
+		t.Errorf("Expected (x) with checksum (%v), found (%+v), (%v)", sum, fi, err)
+	}
+}
@@ -0,0 +1,486 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// chunkSize bounds how much of a file is held in memory (and sent in a
+// single RPC) while transferring it.
+const chunkSize = 1 << 20
+
+// uploadTimeout is how long an upload may go without a chunk before it is
+// aborted and its room given back.
+const uploadTimeout = 10 * time.Minute
+
+type UploadChunkReq struct {
+	ID     Key
+	Offset int64
+	Data   []byte
+}
+
+// ErrChecksumMismatch is returned (wrapped) when received content does not
+// match the SHA-256 checksum it was sent with.
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// checksumSuffix names the file next to every stored file that holds the
+// hex SHA-256 of its content.
+const checksumSuffix = ".sha256"
+
+// callFunc issues a single RPC against a fixed peer.
+type callFunc func(proc string, args interface{}, reply interface{}) error
+
+// pushFile streams the local file at path to a peer, see push.
+func pushFile(call callFunc, path string, uf UploadFileReq) (*UploadFileResp, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return push(call, f, uf)
+}
+
+// push streams the content of f to a peer using the chunked upload protocol:
+// BeginUpload reports how much of the file the peer already has, UploadChunk
+// appends the rest chunk by chunk and CommitUpload makes the file visible. An
+// interrupted upload resumes from the reported offset. The checksum of the
+// content is computed unless uf already carries one.
+func push(call callFunc, f io.ReadSeeker, uf UploadFileReq) (*UploadFileResp, error) {
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	if uf.Checksum == "" {
+		if uf.Checksum, err = checksum(f); err != nil {
+			return nil, err
+		}
+	}
+
+	uf.Content = nil
+	uf.Size = size
+
+	var ufr UploadFileResp
+	if err := call("BeginUpload", uf, &ufr); err != nil {
+		return nil, err
+	}
+
+	if _, err := f.Seek(ufr.Offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	buff := make([]byte, chunkSize)
+	for offset := ufr.Offset; offset < uf.Size; {
+		read, err := io.ReadFull(f, buff)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
+
+		if err := call("UploadChunk", UploadChunkReq{ID: uf.ID, Offset: offset, Data: buff[:read]}, &ufr); err != nil {
+			return nil, err
+		}
+
+		offset = ufr.Offset
+	}
+
+	if err := call("CommitUpload", uf, &ufr); err != nil {
+		return nil, err
+	}
+
+	return &ufr, nil
+}
+
+// pullFile streams a file from a peer chunk by chunk into w and verifies it
+// against the checksum the peer stored for it.
+func pullFile(call callFunc, rf RetrieveFileReq, w io.Writer) (*RetrieveFileResp, error) {
+	rf.Length = chunkSize
+
+	h := sha256.New()
+	w = io.MultiWriter(w, h)
+	for {
+		var rfr RetrieveFileResp
+		if err := call("RetrieveFile", rf, &rfr); err != nil {
+			return nil, err
+		}
+
+		if _, err := w.Write(rfr.Content); err != nil {
+			return nil, err
+		}
+
+		rf.Offset += int64(len(rfr.Content))
+		if rf.Offset < rfr.Size && len(rfr.Content) != 0 {
+			continue
+		}
+
+		rfr.Content = nil
+		if sum := hex.EncodeToString(h.Sum(nil)); sum != rfr.Checksum {
+			return &rfr, fmt.Errorf("%w: file (%v) has checksum (%v), expected (%v)", ErrChecksumMismatch, rf.Filename, sum, rfr.Checksum)
+		}
+
+		return &rfr, nil
+	}
+}
+
+// checksum returns the hex SHA-256 of everything read from r. Seekers are
+// rewound afterwards.
+func checksum(r io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+
+	if s, ok := r.(io.Seeker); ok {
+		if _, err := s.Seek(0, io.SeekStart); err != nil {
+			return "", err
+		}
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// sendFile pushes one of our stored files to addr.
+func (n *Node) sendFile(ctx context.Context, caller Caller, addr string, fileid Key, filename string, replica bool) error {
+	call := func(proc string, args interface{}, reply interface{}) error {
+		return n.call(ctx, caller, addr, proc, args, reply)
+	}
+
+	f, fi, err := n.store.Get(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	owner, name := splitFileName(filename)
+	ufr, err := push(call, f, UploadFileReq{Filename: name, Owner: owner, ID: fileid, Replica: replica, Checksum: fi.Checksum, Stored: fi.ModTime})
+	if err != nil {
+		return err
+	}
+
+	// The peer acknowledges the upload with the checksum it verified.
+	if ufr.Checksum != fi.Checksum {
+		return fmt.Errorf("%w: (%v) acknowledged file (%v) with checksum (%v), expected (%v)", ErrChecksumMismatch, addr, filename, ufr.Checksum, fi.Checksum)
+	}
+
+	return nil
+}
+
+// checksum returns the stored checksum of filename, or "" if there is none.
+func (n *Node) checksum(filename string) string {
+	fi, err := n.store.Stat(filename)
+	if err != nil {
+		return ""
+	}
+
+	return fi.Checksum
+}
+
+// dir returns the directory holding this node's state, its partial uploads
+// and, with the default store, its files.
+func (n *Node) dir() string {
+	return filepath.Join(n.dataDir, n.id().String())
+}
+
+// spoolPath returns where the partially received content of key is kept
+// until the upload is committed.
+func (n *Node) spoolPath(key Key) string {
+	return filepath.Join(n.dir(), ".incoming", key.String())
+}
+
+// removeSpool drops what was received of an upload of key, along with the
+// checksum it was received for.
+func (n *Node) removeSpool(key Key) {
+	spool := n.spoolPath(key)
+	for _, path := range []string{spool, spool + checksumSuffix} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.Println(err)
+		}
+	}
+}
+
+// abortUpload gives up on the upload of key, dropping its spool file and
+// the room set aside for it.
+func (n *Node) abortUpload(key Key) {
+	n.mufile.Lock()
+	defer n.mufile.Unlock()
+
+	n.removeSpool(key)
+	n.usage.release(key)
+}
+
+// expireUploads aborts the uploads that have not made progress for
+// uploadTimeout, so that abandoned ones do not hold on to their room.
+func (n *Node) expireUploads() {
+	n.mufile.Lock()
+	defer n.mufile.Unlock()
+
+	for _, key := range n.usage.expired(time.Now()) {
+		log.Printf("upload of key (%v) expired", key)
+		n.removeSpool(key)
+		n.usage.release(key)
+	}
+}
+
+// beginUpload prepares the spool file of an upload, sets aside room for it
+// and returns how many bytes of it were already received.
+func (n *Node) beginUpload(uf UploadFileReq) (int64, error) {
+	n.mufile.Lock()
+	defer n.mufile.Unlock()
+
+	if err := n.checkQuota(uf.ID, uf.Filename, uf.Size); err != nil {
+		return 0, err
+	}
+
+	offset, err := n.prepareSpool(uf)
+	if err != nil {
+		return 0, err
+	}
+
+	n.usage.reserve(uf.ID, uf.Filename, uf.Size, time.Now().Add(uploadTimeout))
+	return offset, nil
+}
+
+// prepareSpool returns the offset to resume the upload at, starting the
+// spool file over if what is left belongs to another upload. The caller
+// holds n.mufile.
+func (n *Node) prepareSpool(uf UploadFileReq) (int64, error) {
+	spool := n.spoolPath(uf.ID)
+	if err := os.MkdirAll(filepath.Dir(spool), 0700); err != nil {
+		return 0, err
+	}
+
+	// A leftover sent with another checksum, or a longer one, belongs to
+	// some other version of the file.
+	sum, err := ioutil.ReadFile(spool + checksumSuffix)
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+
+	fi, err := os.Stat(spool)
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	if err == nil && string(sum) == uf.Checksum && fi.Size() <= uf.Size {
+		return fi.Size(), nil
+	}
+
+	if err := os.Truncate(spool, 0); err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+
+	return 0, ioutil.WriteFile(spool+checksumSuffix, []byte(uf.Checksum), 0644)
+}
+
+// uploadChunk appends a chunk to the spool file. Chunks must arrive in order
+// and stay within the size the upload was begun with.
+func (n *Node) uploadChunk(uc UploadChunkReq) (int64, error) {
+	n.mufile.Lock()
+	defer n.mufile.Unlock()
+
+	r, ok := n.usage.reserved[uc.ID]
+	if !ok {
+		return 0, fmt.Errorf("no upload of key (%v) was begun", uc.ID)
+	}
+	if end := uc.Offset + int64(len(uc.Data)); end > r.size {
+		return 0, fmt.Errorf("chunk ending at offset %d exceeds the %d bytes of upload of key (%v)", end, r.size, uc.ID)
+	}
+	n.usage.reserve(uc.ID, r.name, r.size, time.Now().Add(uploadTimeout))
+
+	f, err := os.OpenFile(n.spoolPath(uc.ID), os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	if fi.Size() != uc.Offset {
+		return fi.Size(), fmt.Errorf("chunk at offset %d does not continue upload of key (%v) at offset %d", uc.Offset, uc.ID, fi.Size())
+	}
+
+	if _, err := f.WriteAt(uc.Data, uc.Offset); err != nil {
+		return 0, err
+	}
+
+	return uc.Offset + int64(len(uc.Data)), nil
+}
+
+// commitUpload hands a completely received spool file to the store, which
+// verifies it against its checksum. mufile is only held to check the upload
+// and to record it, not while the store reads the content.
+func (n *Node) commitUpload(uf UploadFileReq) error {
+	if uf.Checksum == "" {
+		return fmt.Errorf("upload of key (%v) carries no checksum", uf.ID)
+	}
+
+	spool := n.spoolPath(uf.ID)
+
+	n.mufile.Lock()
+	fi, err := os.Stat(spool)
+	if err == nil && fi.Size() != uf.Size {
+		err = fmt.Errorf("upload of key (%v) is incomplete: received %d of %d bytes", uf.ID, fi.Size(), uf.Size)
+	}
+	// Other uploads may have been committed since this one began.
+	var qe *QuotaError
+	if err == nil {
+		err = n.checkQuota(uf.ID, uf.Filename, uf.Size)
+	}
+	if errors.As(err, &qe) {
+		n.removeSpool(uf.ID)
+		n.usage.release(uf.ID)
+	}
+	n.mufile.Unlock()
+	if err != nil {
+		return err
+	}
+
+	err = n.adopt(uf.Filename, spool, uf.Checksum)
+	if errors.Is(err, ErrChecksumMismatch) {
+		// The spool file is useless now, start over on the next attempt.
+		n.abortUpload(uf.ID)
+		return fmt.Errorf("upload of key (%v): %w", uf.ID, err)
+	}
+	if err != nil {
+		return err
+	}
+
+	n.mufile.Lock()
+	defer n.mufile.Unlock()
+
+	n.removeSpool(uf.ID)
+
+	// A copy the file was deleted after is not taken back in, while a
+	// newer one, or a fresh upload, supersedes the deletion.
+	if ts, ok := n.tombstones[uf.ID]; ok && ts.Name == uf.Filename {
+		if !uf.Stored.IsZero() && !uf.Stored.After(ts.Deleted) {
+			log.Printf("ignoring copy of file (%v) of key (%v) deleted at %v", uf.Filename, uf.ID, ts.Deleted)
+			n.usage.release(uf.ID)
+			n.usage.removed(uf.Filename)
+			delete(n.replicaTable, uf.ID)
+			return n.store.Delete(uf.Filename)
+		}
+		delete(n.tombstones, uf.ID)
+	}
+
+	n.usage.stored(uf.Filename, uf.Size)
+	n.usage.release(uf.ID)
+
+	if uf.Replica {
+		if _, ok := n.fileTable[uf.ID]; !ok {
+			n.replicaTable[uf.ID] = uf.Filename
+		}
+		return nil
+	}
+
+	delete(n.replicaTable, uf.ID)
+	n.fileTable[uf.ID] = uf.Filename
+
+	return nil
+}
+
+// adopt moves the local file at path into the store under name, renaming it
+// if the store supports that and copying it otherwise.
+func (n *Node) adopt(name, path, checksum string) error {
+	if a, ok := n.store.(Adopter); ok {
+		_, err := a.Adopt(name, path, checksum)
+		return err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	_, err = n.store.Put(name, f, checksum)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(path); err != nil {
+		log.Println(err)
+	}
+
+	return nil
+}
+
+func (n *Node) BeginUpload(uf UploadFileReq, ufr *UploadFileResp) error {
+	name, err := n.resolveName(uf.Owner, uf.Filename, uf.ID)
+	if err != nil {
+		return rpcError(err)
+	}
+	uf.Filename = name
+
+	if !uf.Replica {
+		if err := n.checkResponsible(context.Background(), uf.ID, n.caller); err != nil {
+			return err
+		}
+	}
+
+	offset, err := n.beginUpload(uf)
+	if err != nil {
+		return rpcError(err)
+	}
+
+	ufr.Offset = offset
+	return nil
+}
+
+func (n *Node) UploadChunk(uc UploadChunkReq, ufr *UploadFileResp) error {
+	offset, err := n.uploadChunk(uc)
+	if err != nil {
+		return rpcError(err)
+	}
+
+	ufr.Offset = offset
+	return nil
+}
+
+func (n *Node) CommitUpload(uf UploadFileReq, ufr *UploadFileResp) error {
+	name, err := n.resolveName(uf.Owner, uf.Filename, uf.ID)
+	if err != nil {
+		n.abortUpload(uf.ID)
+		return rpcError(err)
+	}
+	uf.Filename = name
+
+	// The range may have moved while the chunks were on their way.
+	if !uf.Replica {
+		if err := n.checkResponsible(context.Background(), uf.ID, n.caller); err != nil {
+			n.abortUpload(uf.ID)
+			return err
+		}
+	}
+
+	if err := n.commitUpload(uf); err != nil {
+		return rpcError(err)
+	}
+
+	ufr.Offset = uf.Size
+	ufr.Checksum = uf.Checksum
+
+	if err := n.saveState(); err != nil {
+		log.Println("saving node state:", err)
+	}
+
+	if !uf.Replica {
+		n.replicate(context.Background(), uf, n.caller)
+	}
+
+	return nil
+}
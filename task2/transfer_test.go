@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// directCall dispatches transfer RPCs straight to n and counts them.
+func directCall(n *Node, calls map[string]int) callFunc {
+	return func(proc string, args interface{}, reply interface{}) error {
+		calls[proc]++
+		switch proc {
+		case "BeginUpload":
+			return n.BeginUpload(args.(UploadFileReq), reply.(*UploadFileResp))
+		case "UploadChunk":
+			return n.UploadChunk(args.(UploadChunkReq), reply.(*UploadFileResp))
+		case "CommitUpload":
+			return n.CommitUpload(args.(UploadFileReq), reply.(*UploadFileResp))
+		case "RetrieveFile":
+			return n.RetrieveFile(args.(RetrieveFileReq), reply.(*RetrieveFileResp))
+		}
+
+		return fmt.Errorf("unsupported procedure (%v)", proc)
+	}
+}
+
+func TestChunkedTransfer(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	content := make([]byte, 2*chunkSize+chunkSize/2)
+	rand.New(rand.NewSource(1)).Read(content)
+	if err := ioutil.WriteFile("big.bin", content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	n := NewNode("localhost:8080", Config{})
+	key := n.hash("big.bin")
+	calls := make(map[string]int)
+	call := directCall(n, calls)
+
+	// Simulate an upload that was interrupted after the first chunk.
+	sum, _ := checksum(bytes.NewReader(content))
+	var resp UploadFileResp
+	if err := call("BeginUpload", UploadFileReq{ID: key, Filename: "big.bin", Size: int64(len(content)), Checksum: sum}, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if err := call("UploadChunk", UploadChunkReq{ID: key, Offset: 0, Data: content[:chunkSize]}, &resp); err != nil {
+		t.Fatal(err)
+	}
+
+	calls["UploadChunk"] = 0
+	ufr, err := pushFile(call, "big.bin", UploadFileReq{ID: key, Filename: "big.bin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ufr.Checksum != sum || n.checksum("big.bin") != sum {
+		t.Errorf("expected checksum (%v) to be returned and stored, found (%v) and (%v)", sum, ufr.Checksum, n.checksum("big.bin"))
+	}
+
+	if calls["UploadChunk"] != 2 {
+		t.Errorf("expected the upload to resume with 2 chunks, found (%v)", calls["UploadChunk"])
+	}
+
+	if _, ok := n.fileTable[key]; !ok {
+		t.Errorf("committed file is missing from the file table")
+	}
+
+	var buff bytes.Buffer
+	rfr, err := pullFile(call, RetrieveFileReq{ID: key, Filename: "big.bin"}, &buff)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rfr.Size != int64(len(content)) || !bytes.Equal(buff.Bytes(), content) {
+		t.Errorf("retrieved content differs from the uploaded one")
+	}
+
+	if calls["RetrieveFile"] != 3 {
+		t.Errorf("expected the file to be retrieved in 3 chunks, found (%v)", calls["RetrieveFile"])
+	}
+
+	if _, err := os.Stat(n.spoolPath(key)); !os.IsNotExist(err) {
+		t.Errorf("spool file was not moved into place")
+	}
+}
+
+func TestResumeOtherVersion(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	v1 := make([]byte, 2*chunkSize)
+	rand.New(rand.NewSource(1)).Read(v1)
+	v2 := make([]byte, 3*chunkSize)
+	rand.New(rand.NewSource(2)).Read(v2)
+	if err := ioutil.WriteFile("big.bin", v2, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	n := NewNode("localhost:8080", Config{})
+	key := n.hash("big.bin")
+	calls := make(map[string]int)
+	call := directCall(n, calls)
+
+	// Interrupt an upload of the first version after its first chunk.
+	sum, _ := checksum(bytes.NewReader(v1))
+	var resp UploadFileResp
+	if err := call("BeginUpload", UploadFileReq{ID: key, Filename: "big.bin", Size: int64(len(v1)), Checksum: sum}, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if err := call("UploadChunk", UploadChunkReq{ID: key, Offset: 0, Data: v1[:chunkSize]}, &resp); err != nil {
+		t.Fatal(err)
+	}
+
+	calls["UploadChunk"] = 0
+	if _, err := pushFile(call, "big.bin", UploadFileReq{ID: key, Filename: "big.bin"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if calls["UploadChunk"] != 3 {
+		t.Errorf("expected the upload to start over with 3 chunks, found (%v)", calls["UploadChunk"])
+	}
+
+	if sum, _ := checksum(bytes.NewReader(v2)); n.checksum("big.bin") != sum {
+		t.Errorf("Expected (%v), found (%v)", sum, n.checksum("big.bin"))
+	}
+}
+
+func TestUploadChunkBounds(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	n := NewNode("localhost:8080", Config{})
+	key := n.hash("a.txt")
+	call := directCall(n, make(map[string]int))
+
+	var resp UploadFileResp
+	if err := call("UploadChunk", UploadChunkReq{ID: key, Offset: 0, Data: []byte("hello")}, &resp); err == nil {
+		t.Errorf("Expected a chunk without an upload to be refused, found (%v)", err)
+	}
+
+	if err := call("BeginUpload", UploadFileReq{ID: key, Filename: "a.txt", Size: 1}, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if err := call("UploadChunk", UploadChunkReq{ID: key, Offset: 0, Data: []byte("hello")}, &resp); err == nil {
+		t.Errorf("Expected a chunk past the size of the upload to be refused, found (%v)", err)
+	}
+	if err := call("UploadChunk", UploadChunkReq{ID: key, Offset: 0, Data: []byte("h")}, &resp); err != nil {
+		t.Errorf("Expected (nil), found (%v)", err)
+	}
+}
+
+func TestChecksumMismatch(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	n := NewNode("localhost:8080", Config{})
+	key := n.hash("a.txt")
+	sum, _ := checksum(bytes.NewReader([]byte("hello")))
+
+	if err := n.uploadFile(UploadFileReq{ID: key, Filename: "a.txt", Content: []byte("hellO"), Checksum: sum}); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("expected a checksum mismatch, found (%v)", err)
+	}
+
+	if _, ok := n.fileTable[key]; ok {
+		t.Errorf("corrupted upload was committed")
+	}
+
+	if err := n.uploadFile(UploadFileReq{ID: key, Filename: "a.txt", Content: []byte("hello"), Checksum: sum}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Corrupt the stored copy behind the node's back.
+	if err := ioutil.WriteFile(filepath.Join(n.dir(), "a.txt"), []byte("jello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var buff bytes.Buffer
+	if _, err := pullFile(directCall(n, make(map[string]int)), RetrieveFileReq{ID: key, Filename: "a.txt"}, &buff); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("expected the corruption to be detected, found (%v)", err)
+	}
+}